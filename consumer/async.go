@@ -1,6 +1,7 @@
 package consumer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -28,7 +29,9 @@ const (
 // an error from the traffic controller.
 //
 // Successive errors will double the sleep time, up to c's max retry delay,
-// set by c.SetMaxRetryDelay.
+// set by c.SetMaxRetryDelay.  If the traffic controller rejects a connection
+// with a 429 or 503 status and a Retry-After header, the requested delay is
+// used instead, up to the max retry delay.
 //
 // Defaults to DefaultMinRetryDelay.
 func (c *Consumer) SetMinRetryDelay(d time.Duration) {
@@ -52,6 +55,17 @@ func (c *Consumer) SetMaxRetryCount(count int) {
 	atomic.StoreInt64(&c.maxRetryCount, int64(count))
 }
 
+// SetSyncRetryCount sets the number of times that RecentLogs,
+// ContainerEnvelopes and ContainerMetrics will retry a request which the
+// traffic controller rejected with a 429 or 503 status and a Retry-After
+// header.  Each retry waits for the duration requested by Retry-After, up to
+// c's max retry delay.
+//
+// Defaults to 0 (no retries).
+func (c *Consumer) SetSyncRetryCount(count int) {
+	atomic.StoreInt64(&c.syncRetryCount, int64(count))
+}
+
 // TailingLogs listens indefinitely for log messages only; other event types
 // are dropped.
 // Whenever an error is encountered, the error will be sent down the error
@@ -139,9 +153,10 @@ func (c *Consumer) FilteredFirehose(
 }
 
 // SetDebugPrinter sets the websocket connection to write debug information to
-// debugPrinter.
+// debugPrinter.  Credentials are redacted from the debug information.  It
+// replaces any DebugEventPrinter set with SetDebugEventPrinter.
 func (c *Consumer) SetDebugPrinter(debugPrinter DebugPrinter) {
-	c.debugPrinter = debugPrinter
+	c.debugPrinter = legacyDebugPrinter{printer: debugPrinter}
 }
 
 // SetOnConnectCallback sets a callback function to be called with the
@@ -153,9 +168,13 @@ func (c *Consumer) SetOnConnectCallback(cb func()) {
 }
 
 // Close terminates all previously opened websocket connections to the traffic
-// controller.  It will return an error if there are no open connections, or
-// if it has problems closing any connection.
+// controller, cancels sync requests in progress, and closes idle connections
+// kept for sync requests.  It will return an error if there are no open
+// websocket connections or sync requests, or if it has problems closing any
+// connection.
 func (c *Consumer) Close() error {
+	c.transport.CloseIdleConnections()
+
 	c.connsLock.Lock()
 	defer c.connsLock.Unlock()
 	if len(c.conns) == 0 {
@@ -174,6 +193,19 @@ func (c *Consumer) SetIdleTimeout(idleTimeout time.Duration) {
 	c.idleTimeout = idleTimeout
 }
 
+// SetGapDetection enables or disables gap detection on automatically
+// reconnecting methods (e.g. Firehose, Stream, TailingLogs).
+//
+// When enabled, the first envelope received after a reconnect causes a
+// noaa_errors.GapError to be sent down the error channel, covering the
+// timestamps of the last envelope before the disconnect and the first one
+// after it.  The stream is not interrupted.
+//
+// Defaults to false.
+func (c *Consumer) SetGapDetection(enabled bool) {
+	c.gapDetection = enabled
+}
+
 func (c *Consumer) onConnectCallback() func() {
 	c.callbackLock.RLock()
 	defer c.callbackLock.RUnlock()
@@ -217,11 +249,12 @@ func (c *Consumer) runStream(appGuid, authToken string, retry bool) (<-chan *eve
 
 func (c *Consumer) streamAppDataTo(conn *connection, appGuid, authToken string, callback func(*events.Envelope), errors chan<- error, retry bool) {
 	streamPath := c.streamPathBuilder(appGuid)
+	conn.errors = errors
 	if retry {
-		c.retryAction(c.listenAction(conn, streamPath, authToken, callback), errors)
+		c.retryListen(conn, streamPath, authToken, callback, errors)
 		return
 	}
-	err, _ := c.listenAction(conn, streamPath, authToken, callback)()
+	err, _ := c.listenAction(conn, streamPath, authToken, callback)(conn.ctx)
 	errors <- err
 }
 
@@ -236,11 +269,12 @@ func (c *Consumer) firehose(options *firehose) (<-chan *events.Envelope, <-chan
 	go func() {
 		defer close(errors)
 		defer close(outputs)
+		conn.errors = errors
 		if options.retry {
-			c.retryAction(c.listenAction(conn, options.streamPath(), options.authToken, callback), errors)
+			c.retryListen(conn, options.streamPath(), options.authToken, callback, errors)
 			return
 		}
-		err, _ := c.listenAction(conn, options.streamPath(), options.authToken, callback)()
+		err, _ := c.listenAction(conn, options.streamPath(), options.authToken, callback)(conn.ctx)
 		errors <- err
 	}()
 	return outputs, errors
@@ -252,10 +286,7 @@ func (c *Consumer) listenForMessages(conn *connection, callback func(*events.Env
 	}
 	ws := conn.websocket()
 	for {
-		if c.idleTimeout != 0 {
-			ws.SetReadDeadline(time.Now().Add(c.idleTimeout))
-		}
-		_, data, err := ws.ReadMessage()
+		data, err := c.readMessage(conn, ws, nil)
 
 		// If the connection was closed (i.e. if conn.Close() was called), we
 		// will have a non-nil error, but we want to return a nil error.
@@ -263,12 +294,8 @@ func (c *Consumer) listenForMessages(conn *connection, callback func(*events.Env
 			return nil
 		}
 
-		if c.isTimeoutErr(err) {
-			return noaa_errors.NewRetryError(err)
-		}
-
 		if err != nil {
-			return err
+			return c.readError(err)
 		}
 
 		envelope := &events.Envelope{}
@@ -281,21 +308,69 @@ func (c *Consumer) listenForMessages(conn *connection, callback func(*events.Env
 	}
 }
 
-func (c *Consumer) listenAction(conn *connection, streamPath, authToken string, callback func(*events.Envelope)) func() (err error, done bool) {
-	return func() (error, bool) {
+// readError converts an error reading from a websocket into the error
+// returned to retryAction.
+func (c *Consumer) readError(err error) error {
+	if c.isTimeoutErr(err) {
+		return noaa_errors.NewRetryError(noaa_errors.NewCodedError(noaa_errors.ERR_IDLE_TIMEOUT, err))
+	}
+
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		err = noaa_errors.NewCloseError(closeErr.Code, closeErr.Text)
+		if closeErr.Code == websocket.CloseNormalClosure {
+			return err
+		}
+	}
+	return noaa_errors.NewCodedError(noaa_errors.ERR_LOST_CONNECTION, err)
+}
+
+func (c *Consumer) listenAction(conn *connection, streamPath, authToken string, callback func(*events.Envelope)) func(ctx context.Context) (err error, done bool) {
+	return func(ctx context.Context) (error, bool) {
 		if conn.closed() {
 			return nil, true
 		}
-		ws, err := c.establishWebsocketConnection(streamPath, authToken)
+		c.reportState(StateEvent{State: StateConnecting, Endpoint: conn.endpoint})
+		var result dialResult
+		ws, token, err := c.establishWebsocketConnection(withDialResult(ctx, &result), conn.endpoint, streamPath, authToken)
 		if err != nil {
+			if isEndpointFailure(err) {
+				c.dialFailed(conn, err)
+			}
 			return err, false
 		}
+		c.endpoints.succeeded(conn.endpoint)
+		conn.dialFailures = 0
+		c.reportState(StateEvent{State: StateConnected, Endpoint: conn.endpoint, Compressed: result.compressed})
+
+		// Reconnect with the latest token, rather than one which has
+		// since been refreshed or rotated.
+		authToken = token
+
 		conn.setWebsocket(ws)
-		return c.listenForMessages(conn, callback), false
+		if rotateAt, ok := c.rotationTime(token); ok {
+			authToken, err = c.listenWithRotation(conn, streamPath, token, rotateAt, callback)
+		} else {
+			err = c.listenForMessages(conn, callback)
+		}
+		c.reportState(StateEvent{State: StateDisconnected, Endpoint: conn.endpoint, Err: err})
+		return err, false
 	}
 }
 
-func (c *Consumer) retryAction(action func() (err error, done bool), errors chan<- error) {
+func (c *Consumer) retryListen(conn *connection, streamPath, authToken string, callback func(*events.Envelope), errors chan<- error) {
+	if !c.gapDetection {
+		c.retryAction(conn.ctx, c.listenAction(conn, streamPath, authToken, callback), conn.done, errors)
+		return
+	}
+	tracker := newGapTracker(conn)
+	c.retryAction(conn.ctx, tracker.action(c.listenAction(conn, streamPath, authToken, tracker.track(callback))), conn.done, errors)
+}
+
+// retryAction calls action until it is done, retrying with increasing delays
+// until the maximum number of retries is reached.  It stops waiting between
+// retries once stop is closed.  Each call is passed a context derived from
+// ctx which carries that attempt's reconnect span.
+func (c *Consumer) retryAction(ctx context.Context, action func(ctx context.Context) (err error, done bool), stop <-chan struct{}, errors chan<- error) {
 	oldConnectCallback := c.onConnectCallback()
 	defer c.SetOnConnectCallback(oldConnectCallback)
 
@@ -305,21 +380,26 @@ func (c *Consumer) retryAction(action func() (err error, done bool), errors chan
 	}
 
 	c.SetOnConnectCallback(func() {
-		atomic.StoreInt64(&context.sleep, atomic.LoadInt64(&c.minRetryDelay))
+		atomic.StoreInt64(&context.connected, time.Now().UnixNano())
+		atomic.StoreInt64(&context.lastSleep, atomic.SwapInt64(&context.sleep, atomic.LoadInt64(&c.minRetryDelay)))
 		atomic.StoreInt64(&context.count, 0)
 		if oldConnectCallback != nil {
 			oldConnectCallback()
 		}
 	})
 
-	for {
-		err, done := action()
+	for cycle := 0; ; cycle++ {
+		actionCtx, span := c.reconnectSpan(ctx, cycle)
+		err, done := action(actionCtx)
+		span.RecordError(err)
 		if done {
+			span.End()
 			return
 		}
 
-		if _, ok := err.(noaa_errors.NonRetryError); ok {
-			c.debugPrinter.Print("WEBSOCKET ERROR", err.Error())
+		if isNonRetryError(err) {
+			c.debug(DebugEvent{Kind: DebugError, Title: "WEBSOCKET ERROR", Err: err})
+			span.End()
 			errors <- err
 			return
 		}
@@ -327,21 +407,63 @@ func (c *Consumer) retryAction(action func() (err error, done bool), errors chan
 		retryCount := atomic.LoadInt64(&context.count)
 		maxRetryCount := atomic.LoadInt64(&c.maxRetryCount)
 		if retryCount >= maxRetryCount {
-			c.debugPrinter.Print("WEBSOCKET ERROR", fmt.Sprintf("Maximum number of retries %d reached", maxRetryCount))
+			c.debug(DebugEvent{
+				Kind:    DebugError,
+				Title:   "WEBSOCKET ERROR",
+				Err:     ErrMaxRetriesReached,
+				Message: fmt.Sprintf("Maximum number of retries %d reached", maxRetryCount),
+			})
+			span.RecordError(ErrMaxRetriesReached)
+			span.End()
 			errors <- ErrMaxRetriesReached
 			return
 		}
 		atomic.StoreInt64(&context.count, retryCount+1)
 
 		if err != nil {
-			c.debugPrinter.Print("WEBSOCKET ERROR", fmt.Sprintf("%s. Retrying...", err.Error()))
+			c.debug(DebugEvent{
+				Kind:    DebugError,
+				Title:   "WEBSOCKET ERROR",
+				Err:     err,
+				Message: fmt.Sprintf("%s. Retrying...", err.Error()),
+			})
 			err = noaa_errors.NewRetryError(err)
 		}
 
 		errors <- err
 
 		ns := atomic.LoadInt64(&context.sleep)
-		time.Sleep(time.Duration(ns))
+		delay := time.Duration(ns)
+		if retryAfter, ok := retryAfterHint(err); ok {
+			delay = c.capRetryAfter(retryAfter)
+			c.debug(DebugEvent{
+				Kind:    DebugRetry,
+				Title:   "WEBSOCKET RETRY",
+				Delay:   delay,
+				Message: fmt.Sprintf("Server requested a delay of %s", retryAfter),
+			})
+		}
+		if code, ok := closeCode(err); ok {
+			// A server which closes streams soon after they connect does not
+			// reset the backoff, so that repeated closes back off
+			// exponentially rather than reconnecting in a tight loop.
+			max := atomic.LoadInt64(&c.maxRetryDelay)
+			if time.Since(time.Unix(0, atomic.LoadInt64(&context.connected))) < time.Duration(max) {
+				ns = atomic.LoadInt64(&context.lastSleep)
+				atomic.StoreInt64(&context.sleep, ns)
+			}
+			delay = c.reconnectDelay(code, time.Duration(ns), time.Duration(max))
+		}
+		span.SetAttributes(Attr("retry_count", retryCount+1), Attr("delay", delay))
+		span.End()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
 		ns = atomic.AddInt64(&context.sleep, ns)
 		max := atomic.LoadInt64(&c.maxRetryDelay)
 		if ns > max {
@@ -350,6 +472,57 @@ func (c *Consumer) retryAction(action func() (err error, done bool), errors chan
 	}
 }
 
+// retryAfterHint returns the delay requested by the traffic controller, if
+// err was caused by a 429 or 503 response with a Retry-After header.
+func retryAfterHint(err error) (time.Duration, bool) {
+	var httpErr *noaa_errors.HTTPError
+	if !errors.As(err, &httpErr) {
+		return 0, false
+	}
+	return httpErr.RetryAfter()
+}
+
+// capRetryAfter limits a delay requested by the traffic controller to the
+// maximum retry delay, so that a misconfigured or hostile server cannot
+// stall a stream or request indefinitely.
+func (c *Consumer) capRetryAfter(retryAfter time.Duration) time.Duration {
+	if max := time.Duration(atomic.LoadInt64(&c.maxRetryDelay)); retryAfter > max {
+		return max
+	}
+	return retryAfter
+}
+
+// closeCode returns the websocket close code sent by the traffic
+// controller, if err was caused by it closing the stream.
+func closeCode(err error) (int, bool) {
+	var closeErr *noaa_errors.CloseError
+	if !errors.As(err, &closeErr) {
+		return 0, false
+	}
+	return closeErr.Code, true
+}
+
+// isEndpointFailure returns true if err shows that a trafficcontroller
+// endpoint could not be reached or is unhealthy, as opposed to rejecting the
+// request.
+func isEndpointFailure(err error) bool {
+	var httpErr *noaa_errors.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError
+	}
+	var authErr *noaa_errors.UnauthorizedError
+	if errors.As(err, &authErr) {
+		return false
+	}
+	code, ok := noaa_errors.Code(err)
+	return ok && code == noaa_errors.ERR_DIAL
+}
+
+func isNonRetryError(err error) bool {
+	var nonRetryErr noaa_errors.NonRetryError
+	return errors.As(err, &nonRetryErr)
+}
+
 func (c *Consumer) isTimeoutErr(err error) bool {
 	if err == nil {
 		return false
@@ -362,53 +535,89 @@ func (c *Consumer) isTimeoutErr(err error) bool {
 }
 
 func (c *Consumer) newConn() *connection {
-	conn := &connection{}
+	return c.newConnContext(context.Background())
+}
+
+// newConnContext returns a connection whose context is cancelled when ctx
+// is done or the connection is closed.
+func (c *Consumer) newConnContext(ctx context.Context) *connection {
+	conn := &connection{done: make(chan struct{}), endpoint: c.endpoints.pick()}
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
 	c.connsLock.Lock()
 	defer c.connsLock.Unlock()
 	c.conns = append(c.conns, conn)
 	return conn
 }
 
-func (c *Consumer) websocketConn(path, authToken string) (*websocket.Conn, error) {
+// newRequestContext returns a context for a sync request which is cancelled
+// when ctx is done or c is closed, and a function to call once the request
+// has finished.
+func (c *Consumer) newRequestContext(ctx context.Context) (context.Context, func()) {
+	conn := &connection{done: make(chan struct{})}
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	c.connsLock.Lock()
+	defer c.connsLock.Unlock()
+	c.conns = append(c.conns, conn)
+	return conn.ctx, func() { c.removeConn(conn) }
+}
+
+// removeConn forgets conn, which is no longer in use, and releases its
+// context.
+func (c *Consumer) removeConn(conn *connection) {
+	conn.cancel()
+	c.connsLock.Lock()
+	defer c.connsLock.Unlock()
+	for i, other := range c.conns {
+		if other == conn {
+			c.conns = append(c.conns[:i], c.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// websocketConn connects to path, returning the websocket and the token it
+// was authorized with.
+func (c *Consumer) websocketConn(ctx context.Context, endpoint, path, authToken string) (*websocket.Conn, string, error) {
 	if authToken == "" && c.refreshTokens {
-		return c.websocketConnNewToken(path)
+		return c.websocketConnNewToken(ctx, endpoint, path)
 	}
 
-	URL, err := url.Parse(c.trafficControllerUrl + path)
+	URL, err := url.Parse(endpoint + path)
 	if err != nil {
-		return nil, noaa_errors.NewNonRetryError(err)
+		return nil, "", noaa_errors.NewNonRetryError(err)
 	}
 
 	if URL.Scheme != "wss" && URL.Scheme != "ws" {
-		return nil, noaa_errors.NewNonRetryError(fmt.Errorf("Invalid scheme '%s'", URL.Scheme))
+		return nil, "", noaa_errors.NewNonRetryError(fmt.Errorf("Invalid scheme '%s'", URL.Scheme))
 	}
 
-	ws, httpErr := c.tryWebsocketConnection(path, authToken)
+	ws, httpErr := c.tryWebsocketConnection(ctx, endpoint, path, authToken)
 	if httpErr != nil {
 		err = httpErr.error
 		if httpErr.statusCode == http.StatusUnauthorized && c.refreshTokens {
-			ws, err = c.websocketConnNewToken(path)
+			c.invalidateToken(authToken)
+			return c.websocketConnNewToken(ctx, endpoint, path)
 		}
 	}
-	return ws, err
+	return ws, authToken, err
 }
 
-func (c *Consumer) websocketConnNewToken(path string) (*websocket.Conn, error) {
-	token, err := c.getToken()
+func (c *Consumer) websocketConnNewToken(ctx context.Context, endpoint, path string) (*websocket.Conn, string, error) {
+	token, err := c.getToken(ctx)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	ws, httpErr := c.tryWebsocketConnection(path, token)
+	ws, httpErr := c.tryWebsocketConnection(ctx, endpoint, path, token)
 	if httpErr != nil {
-		return nil, httpErr.error
+		return nil, "", httpErr.error
 	}
-	return ws, nil
+	return ws, token, nil
 }
 
-func (c *Consumer) establishWebsocketConnection(path, authToken string) (*websocket.Conn, error) {
-	ws, err := c.websocketConn(path, authToken)
+func (c *Consumer) establishWebsocketConnection(ctx context.Context, endpoint, path, authToken string) (*websocket.Conn, string, error) {
+	ws, token, err := c.websocketConn(ctx, endpoint, path, authToken)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	callback := c.onConnectCallback()
@@ -416,55 +625,120 @@ func (c *Consumer) establishWebsocketConnection(path, authToken string) (*websoc
 		callback()
 	}
 
-	return ws, nil
+	return ws, token, nil
 }
 
-func (c *Consumer) tryWebsocketConnection(path, token string) (*websocket.Conn, *httpError) {
-	header := http.Header{"Origin": []string{c.trafficControllerUrl}, "Authorization": []string{token}}
-	url := c.trafficControllerUrl + path
+func (c *Consumer) tryWebsocketConnection(ctx context.Context, endpoint, path, token string) (ws *websocket.Conn, httpErr *httpError) {
+	_, span := c.tracer.Start(ctx, SpanWebsocketDial, Attr("path", path), Attr("endpoint", endpoint))
+	defer func() {
+		if httpErr != nil {
+			span.SetAttributes(Attr("status_code", httpErr.statusCode))
+			span.RecordError(httpErr.error)
+		}
+		span.End()
+	}()
 
-	c.debugPrinter.Print("WEBSOCKET REQUEST",
-		"GET "+path+" HTTP/1.1\n"+
-			"Host: "+c.trafficControllerUrl+"\n"+
-			"Upgrade: websocket\nConnection: Upgrade\nSec-WebSocket-Version: 13\nSec-WebSocket-Key: [HIDDEN]\n"+
-			headersString(header))
+	header := http.Header{"Origin": []string{endpoint}, "Authorization": []string{token}}
+	url := endpoint + path
 
-	ws, resp, err := c.dialer.Dial(url, header)
-	if resp != nil {
-		c.debugPrinter.Print("WEBSOCKET RESPONSE",
-			resp.Proto+" "+resp.Status+"\n"+
-				headersString(resp.Header))
+	requestHeader := http.Header{
+		"Host":                  []string{endpoint},
+		"Upgrade":               []string{"websocket"},
+		"Connection":            []string{"Upgrade"},
+		"Sec-WebSocket-Version": []string{"13"},
+		"Sec-WebSocket-Key":     []string{"[HIDDEN]"},
+	}
+	for name, values := range header {
+		requestHeader[name] = values
 	}
+	c.debug(DebugEvent{
+		Kind:   DebugRequest,
+		Title:  "WEBSOCKET REQUEST",
+		Method: "GET",
+		URL:    url,
+		Proto:  "HTTP/1.1",
+		Header: requestHeader,
+	})
 
-	httpErr := &httpError{}
+	var resp *http.Response
+	dialer, spread, err := c.websocketDialer(ctx, url)
+	if err == nil {
+		ws, resp, err = dialer.Dial(url, header)
+	}
+	spread.done(err == nil || (resp != nil && resp.StatusCode < http.StatusInternalServerError))
+	if spread != nil && spread.dialed != "" {
+		span.SetAttributes(Attr("address", spread.dialed))
+	}
+	if err == nil {
+		recordDialResult(ctx, resp)
+		span.SetAttributes(Attr("compressed", compressionNegotiated(resp)))
+	}
 	if resp != nil {
+		c.debug(DebugEvent{
+			Kind:       DebugResponse,
+			Title:      "WEBSOCKET RESPONSE",
+			URL:        url,
+			Proto:      resp.Proto,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+		})
+	}
+
+	httpErr = &httpError{}
+	if resp != nil && err != nil {
 		if resp.StatusCode == http.StatusUnauthorized {
 			bodyData, _ := ioutil.ReadAll(resp.Body)
 			err = noaa_errors.NewUnauthorizedError(string(bodyData))
+		} else {
+			err = noaa_errors.NewHTTPError(resp, err)
 		}
 		httpErr.statusCode = resp.StatusCode
 	}
 	if err != nil {
-		errMsg := "Error dialing trafficcontroller server: %s.\n" +
+		errMsg := "Error dialing trafficcontroller server: %w.\n" +
 			"Please ask your Cloud Foundry Operator to check the platform configuration (trafficcontroller is %s)."
-		httpErr.error = fmt.Errorf(errMsg, err.Error(), c.trafficControllerUrl)
+		httpErr.error = noaa_errors.NewCodedError(noaa_errors.ERR_DIAL, fmt.Errorf(errMsg, err, endpoint))
+		failure := ConnectionFailure{Path: path, StatusCode: httpErr.statusCode, Err: err}
+		if !c.classify(failure) {
+			httpErr.error = noaa_errors.NewNonRetryError(httpErr.error)
+		}
 		return nil, httpErr
 	}
 	return ws, nil
 }
 
-func headersString(header http.Header) string {
-	var result string
-	for name, values := range header {
-		result += name + ": " + strings.Join(values, ", ") + "\n"
-	}
-	return result
-}
-
 type connection struct {
 	ws       *websocket.Conn
 	isClosed bool
-	lock     sync.Mutex
+	done     chan struct{}
+	// endpoint and dialFailures are only used by the goroutine reading
+	// from the connection.
+	endpoint     string
+	dialFailures int64
+	// errors receives informational errors, which do not end the stream.
+	errors chan<- error
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+}
+
+// report sends err down the connection's error channel, unless the
+// connection is closed first.
+func (c *connection) report(err error) {
+	c.reportUnless(err, nil)
+}
+
+// reportUnless functions like report, but gives up if stop is closed first.
+func (c *connection) reportUnless(err error, stop <-chan struct{}) {
+	if c.errors == nil {
+		return
+	}
+	select {
+	case c.errors <- err:
+	case <-c.done:
+	case <-stop:
+	}
 }
 
 func (c *connection) websocket() *websocket.Conn {
@@ -485,7 +759,11 @@ func (c *connection) setWebsocket(ws *websocket.Conn) {
 func (c *connection) close() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.isClosed = true
+	if !c.isClosed {
+		c.isClosed = true
+		close(c.done)
+		c.cancel()
+	}
 	if c.ws == nil {
 		return nil
 	}
@@ -509,4 +787,9 @@ type retryContext struct {
 	// sleep and count must be the first words within this struct to ensure
 	// 64-bit byte alignment.
 	sleep, count int64
+
+	// connected is when the last connection was made, in nanoseconds since
+	// the epoch, and lastSleep is the value sleep had before being reset by
+	// it.
+	connected, lastSleep int64
 }
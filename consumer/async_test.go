@@ -2,10 +2,12 @@ package consumer_test
 
 import (
 	"crypto/tls"
+	stderrors "errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry/noaa/consumer"
@@ -13,6 +15,7 @@ import (
 	"github.com/cloudfoundry/noaa/test_helpers"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
 	"github.com/onsi/gomega/types"
 
 	. "github.com/onsi/ginkgo"
@@ -159,6 +162,7 @@ var _ = Describe("Consumer (Asynchronous)", func() {
 
 			var body string
 			Eventually(debugPrinter.PrintInput.Dump).Should(Receive(&body))
+			Expect(body).To(HavePrefix("GET /apps/" + appGuid + "/stream HTTP/1.1\n"))
 			Expect(body).To(ContainSubstring("Sec-WebSocket-Version: 13"))
 		})
 
@@ -866,6 +870,476 @@ var _ = Describe("Consumer (Asynchronous)", func() {
 		})
 	})
 
+	Describe("error kinds", func() {
+		var streamErrors <-chan error
+
+		Context("when the authorization fails", func() {
+			BeforeEach(func() {
+				testServer = httptest.NewServer(test_helpers.AuthFailureHandler{Message: "Helpful message"})
+				trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+			})
+
+			JustBeforeEach(func() {
+				_, streamErrors = cnsmr.StreamWithoutReconnect(appGuid, authToken)
+			})
+
+			It("returns an error of the dial and auth kinds", func() {
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(HaveKind(errors.ErrDial))
+				Expect(err).To(HaveKind(errors.ErrAuth))
+
+				var unauthorizedErr *errors.UnauthorizedError
+				Expect(stderrors.As(err, &unauthorizedErr)).To(BeTrue())
+				Expect(unauthorizedErr.Description).To(ContainSubstring("Helpful message"))
+			})
+		})
+
+		Context("when the handshake is rejected", func() {
+			BeforeEach(func() {
+				serverMux := http.NewServeMux()
+				serverMux.HandleFunc("/apps/app-guid/stream", func(resp http.ResponseWriter, req *http.Request) {
+					resp.Header().Set("Retry-After", "30")
+					resp.WriteHeader(http.StatusServiceUnavailable)
+					resp.Write([]byte("try again later"))
+				})
+				testServer = httptest.NewServer(serverMux)
+				trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+				appGuid = "app-guid"
+			})
+
+			JustBeforeEach(func() {
+				_, streamErrors = cnsmr.StreamWithoutReconnect(appGuid, authToken)
+			})
+
+			It("returns an HTTPError with the response details", func() {
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(HaveKind(errors.ErrDial))
+				Expect(err).To(HaveKind(errors.ErrServerStatus))
+
+				var httpErr *errors.HTTPError
+				Expect(stderrors.As(err, &httpErr)).To(BeTrue())
+				Expect(httpErr.StatusCode).To(Equal(http.StatusServiceUnavailable))
+				Expect(httpErr.Header.Get("Retry-After")).To(Equal("30"))
+				Expect(string(httpErr.Body)).To(Equal("try again later"))
+			})
+		})
+
+		Context("when the idle timeout expires", func() {
+			BeforeEach(func() {
+				startFakeTrafficController()
+			})
+
+			JustBeforeEach(func() {
+				cnsmr.SetIdleTimeout(100 * time.Millisecond)
+				_, streamErrors = cnsmr.FirehoseWithoutReconnect("subscription-id", authToken)
+			})
+
+			It("returns an error of the timeout kind", func() {
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(HaveKind(errors.ErrTimeout))
+			})
+		})
+	})
+
+	Describe("Retry-After", func() {
+		var (
+			streamErrors  <-chan error
+			maxRetryDelay time.Duration
+		)
+
+		BeforeEach(func() {
+			serverMux := http.NewServeMux()
+			serverMux.HandleFunc("/apps/app-guid/stream", func(resp http.ResponseWriter, req *http.Request) {
+				resp.Header().Set("Retry-After", "1")
+				resp.WriteHeader(http.StatusServiceUnavailable)
+			})
+			testServer = httptest.NewServer(serverMux)
+			trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+			appGuid = "app-guid"
+			maxRetryDelay = 2 * time.Second
+		})
+
+		JustBeforeEach(func() {
+			cnsmr.SetMaxRetryDelay(maxRetryDelay)
+			_, streamErrors = cnsmr.Stream(appGuid, authToken)
+		})
+
+		It("waits for the requested delay before reconnecting", func() {
+			Eventually(streamErrors).Should(Receive(BeRetryable()))
+			start := time.Now()
+			Eventually(streamErrors, 2*time.Second).Should(Receive(BeRetryable()))
+			Expect(time.Since(start)).To(BeNumerically("~", time.Second, 200*time.Millisecond))
+		})
+
+		It("stops waiting when the consumer is closed", func() {
+			Eventually(streamErrors).Should(Receive(BeRetryable()))
+			cnsmr.Close()
+
+			Eventually(streamErrors, 500*time.Millisecond).Should(BeClosed())
+		})
+
+		Context("when the requested delay is longer than the max retry delay", func() {
+			BeforeEach(func() {
+				maxRetryDelay = 100 * time.Millisecond
+			})
+
+			It("waits for the max retry delay", func() {
+				Eventually(streamErrors).Should(Receive(BeRetryable()))
+				start := time.Now()
+				Eventually(streamErrors).Should(Receive(BeRetryable()))
+				Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+			})
+		})
+	})
+
+	Describe("error codes", func() {
+		var streamErrors <-chan error
+
+		Context("when the connection cannot be established", func() {
+			BeforeEach(func() {
+				server := httptest.NewServer(http.NotFoundHandler())
+				trafficControllerURL = "ws://" + server.Listener.Addr().String()
+				server.Close()
+			})
+
+			It("returns ERR_DIAL", func() {
+				_, streamErrors = cnsmr.StreamWithoutReconnect(appGuid, authToken)
+
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(HaveCode(errors.ERR_DIAL))
+			})
+		})
+
+		Context("when the server closes the connection abnormally", func() {
+			BeforeEach(func() {
+				testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+					upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+					ws, err := upgrader.Upgrade(rw, r, nil)
+					if err != nil {
+						return
+					}
+					defer ws.Close()
+					ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "slow consumer"), time.Time{})
+				}))
+				trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+			})
+
+			It("returns ERR_LOST_CONNECTION with the close code and reason", func() {
+				_, streamErrors = cnsmr.StreamWithoutReconnect(appGuid, authToken)
+
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(HaveCode(errors.ERR_LOST_CONNECTION))
+				Expect(stderrors.Is(err, consumer.ErrLostConnection)).To(BeTrue())
+
+				var closeErr *errors.CloseError
+				Expect(stderrors.As(err, &closeErr)).To(BeTrue())
+				Expect(closeErr.Code).To(Equal(websocket.ClosePolicyViolation))
+				Expect(closeErr.Reason).To(Equal("slow consumer"))
+			})
+
+			It("wraps ERR_LOST_CONNECTION in a RetryError when reconnecting", func() {
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(BeRetryable())
+				Expect(err).To(HaveCode(errors.ERR_LOST_CONNECTION))
+			})
+		})
+
+		Context("when the idle timeout expires", func() {
+			BeforeEach(func() {
+				startFakeTrafficController()
+			})
+
+			It("returns ERR_IDLE_TIMEOUT", func() {
+				cnsmr.SetIdleTimeout(100 * time.Millisecond)
+				_, streamErrors = cnsmr.FirehoseWithoutReconnect("subscription-id", authToken)
+
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(HaveCode(errors.ERR_IDLE_TIMEOUT))
+			})
+		})
+
+		Context("when the maximum number of retries is reached", func() {
+			BeforeEach(func() {
+				startFakeTrafficController()
+				fakeHandler.Fail = true
+				maxRetryCount = 1
+			})
+
+			It("returns ERR_MAX_RETRIES", func() {
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+
+				Eventually(streamErrors).Should(Receive(BeRetryable()))
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(HaveCode(errors.ERR_MAX_RETRIES))
+			})
+		})
+	})
+
+	Describe("SetReconnectPolicy", func() {
+		var (
+			closeCode    int32
+			streamErrors <-chan error
+		)
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&closeCode, websocket.CloseGoingAway)
+			testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+				ws, err := upgrader.Upgrade(rw, r, nil)
+				if err != nil {
+					return
+				}
+				defer ws.Close()
+				code := int(atomic.LoadInt32(&closeCode))
+				ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, "closing"), time.Time{})
+			}))
+			trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+		})
+
+		var reconnectDelays = func() <-chan time.Duration {
+			delays := make(chan time.Duration, 100)
+			go func() {
+				last := time.Now()
+				for range streamErrors {
+					select {
+					case delays <- time.Since(last):
+					default:
+					}
+					last = time.Now()
+				}
+			}()
+			return delays
+		}
+
+		It("reconnects after less than the min retry delay when the server is going away", func() {
+			_, streamErrors = cnsmr.Stream(appGuid, authToken)
+			delays := reconnectDelays()
+
+			Eventually(delays).Should(Receive())
+			Eventually(delays).Should(Receive(BeNumerically("<", 150*time.Millisecond)))
+		})
+
+		It("backs off when the server keeps going away soon after connecting", func() {
+			_, streamErrors = cnsmr.Stream(appGuid, authToken)
+			delays := reconnectDelays()
+
+			time.Sleep(time.Second)
+			Expect(len(delays)).To(BeNumerically("<", 20))
+		})
+
+		Context("when the server reports a policy violation", func() {
+			BeforeEach(func() {
+				atomic.StoreInt32(&closeCode, websocket.ClosePolicyViolation)
+			})
+
+			It("waits for the max retry delay", func() {
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+				delays := reconnectDelays()
+
+				Eventually(delays).Should(Receive())
+				Eventually(delays).Should(Receive(BeNumerically("~", 500*time.Millisecond, 100*time.Millisecond)))
+			})
+
+			It("uses a custom policy", func() {
+				codes := make(chan int, 100)
+				cnsmr.SetReconnectPolicy(func(code int, backoff, max time.Duration) time.Duration {
+					codes <- code
+					return 0
+				})
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+				delays := reconnectDelays()
+
+				Eventually(codes).Should(Receive(Equal(websocket.ClosePolicyViolation)))
+				Eventually(delays).Should(Receive())
+				Eventually(delays).Should(Receive(BeNumerically("<", 50*time.Millisecond)))
+			})
+		})
+
+		Context("when the server closes normally", func() {
+			BeforeEach(func() {
+				atomic.StoreInt32(&closeCode, websocket.CloseNormalClosure)
+			})
+
+			It("returns a CloseError without a code", func() {
+				_, streamErrors = cnsmr.StreamWithoutReconnect(appGuid, authToken)
+
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(Equal(errors.NewCloseError(websocket.CloseNormalClosure, "closing")))
+				Expect(err.Error()).To(Equal("websocket: close 1000: closing"))
+			})
+		})
+	})
+
+	Describe("retry classification", func() {
+		var (
+			status       int
+			streamErrors <-chan error
+		)
+
+		BeforeEach(func() {
+			status = http.StatusForbidden
+			testServer = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				resp.WriteHeader(status)
+			}))
+			trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+			appGuid = "app-guid"
+		})
+
+		Context("when the handshake is forbidden", func() {
+			JustBeforeEach(func() {
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+			})
+
+			It("does not retry", func() {
+				var err error
+				Eventually(streamErrors).Should(Receive(&err))
+				Expect(err).To(BeAssignableToTypeOf(errors.NonRetryError{}))
+				Eventually(streamErrors).Should(BeClosed())
+			})
+		})
+
+		Context("when the path is not found", func() {
+			BeforeEach(func() {
+				status = http.StatusNotFound
+			})
+
+			It("does not retry the firehose", func() {
+				_, streamErrors = cnsmr.Firehose("subscription-id", authToken)
+
+				Eventually(streamErrors).Should(Receive(BeAssignableToTypeOf(errors.NonRetryError{})))
+				Eventually(streamErrors).Should(BeClosed())
+			})
+
+			It("retries app streams", func() {
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+
+				Eventually(streamErrors).Should(Receive(BeRetryable()))
+				Eventually(streamErrors).Should(Receive(BeRetryable()))
+			})
+		})
+
+		Context("when the server certificate cannot be verified", func() {
+			BeforeEach(func() {
+				testServer.Close()
+				testServer = httptest.NewTLSServer(NewWebsocketHandler(messagesToSend, 100*time.Millisecond))
+				trafficControllerURL = "wss://" + testServer.Listener.Addr().String()
+			})
+
+			JustBeforeEach(func() {
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+			})
+
+			It("does not retry", func() {
+				Eventually(streamErrors).Should(Receive(BeAssignableToTypeOf(errors.NonRetryError{})))
+				Eventually(streamErrors).Should(BeClosed())
+			})
+		})
+
+		Context("with a custom classifier", func() {
+			var failures chan consumer.ConnectionFailure
+
+			JustBeforeEach(func() {
+				failures = make(chan consumer.ConnectionFailure, 100)
+				cnsmr.SetRetryClassifier(func(failure consumer.ConnectionFailure) bool {
+					failures <- failure
+					return true
+				})
+				_, streamErrors = cnsmr.Stream(appGuid, authToken)
+			})
+
+			It("uses the classifier", func() {
+				Eventually(streamErrors).Should(Receive(BeRetryable()))
+
+				var failure consumer.ConnectionFailure
+				Eventually(failures).Should(Receive(&failure))
+				Expect(failure.Path).To(Equal("/apps/app-guid/stream"))
+				Expect(failure.StatusCode).To(Equal(http.StatusForbidden))
+				Expect(failure.Err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("SetGapDetection", func() {
+		var (
+			envelopes    <-chan *events.Envelope
+			streamErrors <-chan error
+		)
+
+		BeforeEach(func() {
+			startFakeTrafficController()
+		})
+
+		JustBeforeEach(func() {
+			cnsmr.SetGapDetection(true)
+			envelopes, streamErrors = cnsmr.Stream(appGuid, authToken)
+		})
+
+		It("reports the gap between envelopes on either side of a reconnect", func() {
+			fakeHandler.InputChan <- marshalMessage(createMessage("before", 1000))
+			Eventually(envelopes).Should(Receive())
+
+			fakeHandler.Close()
+			Eventually(streamErrors).Should(Receive(BeRetryable()))
+			fakeHandler.Reset()
+			fakeHandler.InputChan <- marshalMessage(createMessage("after", 5000))
+
+			var gapErr errors.GapError
+			Eventually(func() bool {
+				var ok bool
+				select {
+				case err := <-streamErrors:
+					gapErr, ok = err.(errors.GapError)
+				default:
+				}
+				return ok
+			}).Should(BeTrue())
+			Expect(gapErr.Start).To(Equal(time.Unix(0, 1000)))
+			Expect(gapErr.End).To(Equal(time.Unix(0, 5000)))
+			Expect(gapErr.Attempts).To(BeNumerically(">=", 1))
+
+			var env *events.Envelope
+			Eventually(envelopes).Should(Receive(&env))
+			Expect(env.GetLogMessage().GetMessage()).To(Equal([]byte("after")))
+		})
+
+		It("drops the gap when closed while the error channel is full", func() {
+			fakeHandler.InputChan <- marshalMessage(createMessage("before", 1000))
+			Eventually(envelopes).Should(Receive())
+
+			fakeHandler.Close()
+			fakeHandler.Reset()
+			fakeHandler.InputChan <- marshalMessage(createMessage("after", 5000))
+			Consistently(envelopes, 200*time.Millisecond).ShouldNot(Receive())
+
+			cnsmr.Close()
+			Eventually(envelopes).Should(Receive())
+			for err := range streamErrors {
+				Expect(err).ToNot(BeAssignableToTypeOf(errors.GapError{}))
+			}
+		})
+
+		It("does not report a gap before any envelopes are received", func() {
+			fakeHandler.Close()
+			Eventually(streamErrors).Should(Receive(BeRetryable()))
+			fakeHandler.Reset()
+			fakeHandler.InputChan <- marshalMessage(createMessage("first", 5000))
+
+			Eventually(envelopes).Should(Receive())
+			Consistently(streamErrors).ShouldNot(Receive(BeAssignableToTypeOf(errors.GapError{})))
+		})
+	})
+
 	Describe("FirehoseWithoutReconnect", func() {
 		var (
 			incomings    <-chan *events.Envelope
@@ -1022,6 +1496,19 @@ func BeRetryable() types.GomegaMatcher {
 	return BeAssignableToTypeOf(errors.NewRetryError(fmt.Errorf("some-error")))
 }
 
+func HaveCode(code int32) types.GomegaMatcher {
+	return WithTransform(func(err error) int32 {
+		c, _ := errors.Code(err)
+		return c
+	}, Equal(code))
+}
+
+func HaveKind(kind error) types.GomegaMatcher {
+	return WithTransform(func(err error) bool {
+		return stderrors.Is(err, kind)
+	}, BeTrue())
+}
+
 func createError(message string) *events.Envelope {
 	timestamp := time.Now().UnixNano()
 
@@ -0,0 +1,177 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRefreshBefore     = time.Minute
+	DefaultMinRefreshBackoff = time.Second
+	DefaultMaxRefreshBackoff = time.Minute
+)
+
+// CachingTokenRefresher is a TokenRefresher which wraps another
+// TokenRefresher, so that many connections and requests can share a single
+// token.
+//
+// The token is reused until shortly before the expiry in its JWT "exp" claim
+// (or, if it has none, until the trafficcontroller rejects it).  Concurrent
+// calls while a refresh is in flight wait for and share its result, and after
+// a failed refresh the wrapped TokenRefresher is not called again until a
+// back-off delay has passed.
+type CachingTokenRefresher struct {
+	refresher     TokenRefresher
+	refreshBefore time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+
+	lock       sync.Mutex
+	token      string
+	expiry     time.Time
+	err        error
+	backoff    time.Duration
+	retryAt    time.Time
+	refreshing chan struct{}
+}
+
+type CachingTokenRefresherOption func(*CachingTokenRefresher)
+
+// WithRefreshBefore sets how long before a token's expiry it is refreshed.
+// Defaults to DefaultRefreshBefore.
+func WithRefreshBefore(d time.Duration) CachingTokenRefresherOption {
+	return func(r *CachingTokenRefresher) {
+		r.refreshBefore = d
+	}
+}
+
+// WithRefreshBackoff sets the delay after a failed refresh before the
+// wrapped TokenRefresher is called again.  The delay starts at min and
+// doubles with each successive failure, up to max.  Defaults to
+// DefaultMinRefreshBackoff and DefaultMaxRefreshBackoff.
+func WithRefreshBackoff(min, max time.Duration) CachingTokenRefresherOption {
+	return func(r *CachingTokenRefresher) {
+		r.minBackoff = min
+		r.maxBackoff = max
+	}
+}
+
+// NewCachingTokenRefresher wraps refresher in a CachingTokenRefresher.
+func NewCachingTokenRefresher(refresher TokenRefresher, opts ...CachingTokenRefresherOption) *CachingTokenRefresher {
+	r := &CachingTokenRefresher{
+		refresher:     refresher,
+		refreshBefore: DefaultRefreshBefore,
+		minBackoff:    DefaultMinRefreshBackoff,
+		maxBackoff:    DefaultMaxRefreshBackoff,
+	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	return r
+}
+
+// RefreshAuthToken implements TokenRefresher.  It returns the cached token
+// if it is still fresh, and otherwise refreshes it.
+func (r *CachingTokenRefresher) RefreshAuthToken() (string, error) {
+	return r.RefreshAuthTokenContext(context.Background())
+}
+
+// RefreshAuthTokenContext implements ContextTokenRefresher.  If ctx is done
+// while waiting for another caller's refresh, ctx.Err() is returned.  ctx is
+// passed on to the wrapped TokenRefresher if it is a ContextTokenRefresher;
+// a refresh cancelled that way does not cause a back-off.
+func (r *CachingTokenRefresher) RefreshAuthTokenContext(ctx context.Context) (string, error) {
+	r.lock.Lock()
+	for {
+		now := time.Now()
+		if r.fresh(now) {
+			defer r.lock.Unlock()
+			return r.token, nil
+		}
+
+		if r.err != nil && now.Before(r.retryAt) {
+			defer r.lock.Unlock()
+			if r.usable(now) {
+				return r.token, nil
+			}
+			return "", r.err
+		}
+
+		if r.refreshing == nil {
+			break
+		}
+
+		// Another caller is refreshing the token; wait for its result.
+		refreshing := r.refreshing
+		r.lock.Unlock()
+		select {
+		case <-refreshing:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		r.lock.Lock()
+	}
+
+	refreshing := make(chan struct{})
+	r.refreshing = refreshing
+	r.lock.Unlock()
+
+	token, err := refreshToken(ctx, r.refresher)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	defer close(refreshing)
+	r.refreshing = nil
+	if err != nil && ctx.Err() != nil {
+		return "", err
+	}
+	r.err = err
+	if err != nil {
+		r.backoff *= 2
+		if r.backoff < r.minBackoff {
+			r.backoff = r.minBackoff
+		}
+		if r.backoff > r.maxBackoff {
+			r.backoff = r.maxBackoff
+		}
+		r.retryAt = time.Now().Add(r.backoff)
+		return "", err
+	}
+
+	r.backoff = 0
+	r.token = token
+	r.expiry, _ = tokenExpiry(token)
+	return token, nil
+}
+
+// InvalidateAuthToken implements TokenInvalidator.  If token is the cached
+// token, it is discarded so that the next call to RefreshAuthToken fetches a
+// new one.
+func (r *CachingTokenRefresher) InvalidateAuthToken(token string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if token != r.token {
+		return
+	}
+	r.token = ""
+	r.expiry = time.Time{}
+}
+
+// fresh reports whether the cached token can be returned without a refresh.
+func (r *CachingTokenRefresher) fresh(now time.Time) bool {
+	if r.token == "" {
+		return false
+	}
+	return r.expiry.IsZero() || now.Before(r.expiry.Add(-r.refreshBefore))
+}
+
+// usable reports whether the cached token has not yet expired.
+func (r *CachingTokenRefresher) usable(now time.Time) bool {
+	if r.token == "" {
+		return false
+	}
+	return r.expiry.IsZero() || now.Before(r.expiry)
+}
@@ -0,0 +1,256 @@
+package consumer_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CachingTokenRefresher", func() {
+	var (
+		fake      *countingTokenRefresher
+		refresher *consumer.CachingTokenRefresher
+	)
+
+	BeforeEach(func() {
+		fake = &countingTokenRefresher{}
+		refresher = consumer.NewCachingTokenRefresher(fake,
+			consumer.WithRefreshBefore(time.Minute),
+			consumer.WithRefreshBackoff(50*time.Millisecond, 100*time.Millisecond),
+		)
+	})
+
+	It("reuses a token until shortly before it expires", func() {
+		fake.tokens = []string{jwtExpiringIn(time.Hour), "second"}
+
+		first, err := refresher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		second, err := refresher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(second).To(Equal(first))
+		Expect(fake.count()).To(Equal(1))
+	})
+
+	It("refreshes a token which is about to expire", func() {
+		expiring := jwtExpiringIn(30 * time.Second)
+		fake.tokens = []string{expiring, "second"}
+
+		token, err := refresher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal(expiring))
+
+		token, err = refresher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("second"))
+		Expect(fake.count()).To(Equal(2))
+	})
+
+	It("understands tokens with a bearer prefix", func() {
+		fake.tokens = []string{"bearer " + jwtExpiringIn(time.Hour)}
+
+		refresher.RefreshAuthToken()
+		refresher.RefreshAuthToken()
+		Expect(fake.count()).To(Equal(1))
+	})
+
+	It("reuses a token without an expiry until it is invalidated", func() {
+		fake.tokens = []string{"opaque-token", "second"}
+
+		token, _ := refresher.RefreshAuthToken()
+		Expect(token).To(Equal("opaque-token"))
+		token, _ = refresher.RefreshAuthToken()
+		Expect(token).To(Equal("opaque-token"))
+
+		refresher.InvalidateAuthToken("some-other-token")
+		token, _ = refresher.RefreshAuthToken()
+		Expect(token).To(Equal("opaque-token"))
+
+		refresher.InvalidateAuthToken("opaque-token")
+		token, _ = refresher.RefreshAuthToken()
+		Expect(token).To(Equal("second"))
+	})
+
+	It("refreshes only once for concurrent callers", func() {
+		fake.tokens = []string{"only-token"}
+		fake.delay = 100 * time.Millisecond
+
+		var wg sync.WaitGroup
+		tokens := make(chan string, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				token, _ := refresher.RefreshAuthToken()
+				tokens <- token
+			}()
+		}
+		wg.Wait()
+		close(tokens)
+
+		Expect(fake.count()).To(Equal(1))
+		for token := range tokens {
+			Expect(token).To(Equal("only-token"))
+		}
+	})
+
+	It("backs off after the refresher fails", func() {
+		fake.err = errors.New("uaa is down")
+
+		_, err := refresher.RefreshAuthToken()
+		Expect(err).To(MatchError("uaa is down"))
+		_, err = refresher.RefreshAuthToken()
+		Expect(err).To(MatchError("uaa is down"))
+		Expect(fake.count()).To(Equal(1))
+
+		fake.setErr(nil)
+		fake.tokens = []string{"recovered"}
+		Eventually(func() string {
+			token, _ := refresher.RefreshAuthToken()
+			return token
+		}).Should(Equal("recovered"))
+		Expect(fake.count()).To(Equal(2))
+	})
+
+	It("keeps returning an unexpired token while backing off", func() {
+		expiring := jwtExpiringIn(30 * time.Second)
+		fake.tokens = []string{expiring}
+		refresher.RefreshAuthToken()
+
+		fake.setErr(errors.New("uaa is down"))
+		_, err := refresher.RefreshAuthToken()
+		Expect(err).To(HaveOccurred())
+
+		token, err := refresher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal(expiring))
+	})
+
+	It("stops waiting for another caller's refresh when its context is done", func() {
+		fake.tokens = []string{"slow-token"}
+		fake.delay = 200 * time.Millisecond
+		go refresher.RefreshAuthToken()
+		Eventually(fake.count).Should(Equal(1))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := refresher.RefreshAuthTokenContext(ctx)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("does not back off after a cancelled refresh", func() {
+		blocking := &blockingTokenRefresher{
+			called:    make(chan struct{}, 10),
+			cancelled: make(chan error, 10),
+		}
+		refresher = consumer.NewCachingTokenRefresher(blocking,
+			consumer.WithRefreshBackoff(time.Minute, time.Minute),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := refresher.RefreshAuthTokenContext(ctx)
+		Expect(err).To(Equal(context.Canceled))
+
+		ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		refresher.RefreshAuthTokenContext(ctx)
+		Expect(blocking.called).To(HaveLen(2))
+	})
+
+	Context("used by a Consumer", func() {
+		var (
+			statuses chan int
+			server   *httptest.Server
+			cnsmr    *consumer.Consumer
+		)
+
+		BeforeEach(func() {
+			statuses = make(chan int, 10)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case status := <-statuses:
+					w.WriteHeader(status)
+				default:
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+
+			cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+			cnsmr.RefreshTokenFrom(refresher)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("shares one token between requests", func() {
+			fake.tokens = []string{"opaque-token"}
+
+			cnsmr.RecentLogs("some-fake-app-guid", "")
+			cnsmr.RecentLogs("some-fake-app-guid", "")
+			Expect(fake.count()).To(Equal(1))
+		})
+
+		It("invalidates the cached token when it is rejected", func() {
+			fake.tokens = []string{"rejected-token", "new-token"}
+
+			cnsmr.RecentLogs("some-fake-app-guid", "")
+			statuses <- http.StatusUnauthorized
+			cnsmr.RecentLogs("some-fake-app-guid", "rejected-token")
+			Expect(fake.count()).To(Equal(2))
+		})
+	})
+})
+
+type countingTokenRefresher struct {
+	lock   sync.Mutex
+	tokens []string
+	err    error
+	delay  time.Duration
+	calls  int32
+}
+
+func (r *countingTokenRefresher) RefreshAuthToken() (string, error) {
+	atomic.AddInt32(&r.calls, 1)
+	time.Sleep(r.delay)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return "", r.err
+	}
+	token := r.tokens[0]
+	if len(r.tokens) > 1 {
+		r.tokens = r.tokens[1:]
+	}
+	return token, nil
+}
+
+func (r *countingTokenRefresher) setErr(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.err = err
+}
+
+func (r *countingTokenRefresher) count() int {
+	return int(atomic.LoadInt32(&r.calls))
+}
+
+func jwtExpiringIn(d time.Duration) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"none"}`))
+	claims := enc.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(d).Unix())))
+	return header + "." + claims + ".signature"
+}
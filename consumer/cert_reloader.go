@@ -0,0 +1,178 @@
+package consumer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader loads a client certificate and key, and a CA bundle, from
+// files, and reloads them whenever the files change.  It is used through the
+// tls.Config returned by TLSConfig, which consults the CertReloader on every
+// TLS handshake, so rotated certificates apply to new connections without
+// recreating the Consumer.
+type CertReloader struct {
+	certFile, keyFile, caFile string
+
+	lock   sync.RWMutex
+	cert   *tls.Certificate
+	roots  *x509.CertPool
+	stamps map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertReloader returns a CertReloader for the given files.  certFile and
+// keyFile may both be empty, in which case no client certificate is
+// presented.  caFile may be empty, in which case the system roots are used
+// to verify the server.  It returns an error if the files cannot be loaded.
+func NewCertReloader(certFile, keyFile, caFile string) (*CertReloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both or neither of certFile and keyFile must be given")
+	}
+
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files, replacing the current certificate and CA bundle.
+// If loading fails, the current ones are kept.
+func (r *CertReloader) Reload() error {
+	stamps := r.stat()
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate: %w", err)
+		}
+		cert = &c
+	}
+
+	var roots *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("loading CA bundle: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("loading CA bundle: no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = cert
+	r.roots = roots
+	r.stamps = stamps
+	return nil
+}
+
+// TLSConfig returns a tls.Config which presents the current client
+// certificate and verifies the server against the current CA bundle.  The
+// files are checked for changes at each handshake.
+//
+// The server's certificate is verified for serverName.  If serverName is
+// empty, each connection is instead verified for the host it was dialed
+// with, so one config can be shared by endpoints on different hosts; this
+// requires Go 1.15 or later, and connections dialed by IP address, which
+// carry no name, fail verification.  Verification is never skipped for
+// want of a name.
+//
+// Verification is done by the CertReloader rather than crypto/tls, so the
+// returned config has InsecureSkipVerify set; do not clear it.
+func (r *CertReloader) TLSConfig(serverName string) *tls.Config {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.reloadIfChanged()
+
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			if r.cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return r.cert, nil
+		},
+	}
+	r.setVerifier(config, serverName)
+	return config
+}
+
+var errNoServerName = errors.New("no server name to verify the server's certificate against")
+
+func (r *CertReloader) verify(serverName string, certs []*x509.Certificate) error {
+	if serverName == "" {
+		return errNoServerName
+	}
+	if len(certs) == 0 {
+		return errors.New("server presented no certificates")
+	}
+
+	r.lock.RLock()
+	roots := r.roots
+	r.lock.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// reloadIfChanged reloads the files if any of them has been modified since
+// they were last loaded.  A failed reload keeps the current certificates, so
+// that a partially written file does not break new connections.
+func (r *CertReloader) reloadIfChanged() {
+	stamps := r.stat()
+
+	r.lock.RLock()
+	changed := false
+	for name, stamp := range stamps {
+		if r.stamps[name] != stamp {
+			changed = true
+		}
+	}
+	r.lock.RUnlock()
+
+	if changed {
+		r.Reload()
+	}
+}
+
+func (r *CertReloader) stat() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		stamps[name] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps
+}
@@ -0,0 +1,19 @@
+//go:build go1.15
+// +build go1.15
+
+package consumer
+
+import "crypto/tls"
+
+// setVerifier makes config verify the server with r, for serverName or, if
+// it is empty, for the name each connection was dialed with.
+func (r *CertReloader) setVerifier(config *tls.Config, serverName string) {
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		r.reloadIfChanged()
+		name := serverName
+		if name == "" {
+			name = cs.ServerName
+		}
+		return r.verify(name, cs.PeerCertificates)
+	}
+}
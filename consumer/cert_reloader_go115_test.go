@@ -0,0 +1,76 @@
+//go:build go1.15
+// +build go1.15
+
+package consumer_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/noaa/consumer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CertReloader without a server name", func() {
+	var (
+		dir      string
+		caFile   string
+		serverCA *testCA
+		server   *httptest.Server
+		reloader *consumer.CertReloader
+
+		localhostURL string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cert-reloader")
+		Expect(err).ToNot(HaveOccurred())
+		caFile = filepath.Join(dir, "ca.crt")
+
+		serverCA = newTestCA("server-ca")
+		writeFile(caFile, serverCA.certPEM)
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCA.issue("localhost")}}
+		server.StartTLS()
+		_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		localhostURL = "wss://localhost:" + port
+
+		reloader, err = consumer.NewCertReloader("", "", caFile)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("verifies each server for the host it was dialed with", func() {
+		cnsmr := consumer.New(localhostURL, reloader.TLSConfig(""), nil)
+		defer cnsmr.Close()
+
+		_, err := cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(err).To(MatchError(consumer.ErrBadResponse))
+	})
+
+	It("rejects a server whose certificate is for another host", func() {
+		server.TLS.Certificates = []tls.Certificate{serverCA.issue("doppler.example.com")}
+		cnsmr := consumer.New(localhostURL, reloader.TLSConfig(""), nil)
+		defer cnsmr.Close()
+
+		_, err := cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(err).To(HaveOccurred())
+		Expect(err).ToNot(MatchError(consumer.ErrBadResponse))
+	})
+})
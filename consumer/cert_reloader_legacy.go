@@ -0,0 +1,31 @@
+//go:build !go1.15
+// +build !go1.15
+
+package consumer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// setVerifier makes config verify the server with r, for serverName.  Before
+// Go 1.15, the name each connection was dialed with is not available, so an
+// empty serverName fails every handshake.
+func (r *CertReloader) setVerifier(config *tls.Config, serverName string) {
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		r.reloadIfChanged()
+		if serverName == "" {
+			return errNoServerName
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		return r.verify(serverName, certs)
+	}
+}
@@ -0,0 +1,232 @@
+package consumer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CertReloader", func() {
+	var (
+		dir                       string
+		certFile, keyFile, caFile string
+		serverCA, otherCA         *testCA
+		server                    *httptest.Server
+		clientNames               chan string
+		reloader                  *consumer.CertReloader
+		cnsmr                     *consumer.Consumer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cert-reloader")
+		Expect(err).ToNot(HaveOccurred())
+		certFile = filepath.Join(dir, "client.crt")
+		keyFile = filepath.Join(dir, "client.key")
+		caFile = filepath.Join(dir, "ca.crt")
+
+		serverCA = newTestCA("server-ca")
+		otherCA = newTestCA("other-ca")
+
+		clientNames = make(chan string, 10)
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientNames <- r.TLS.PeerCertificates[0].Subject.CommonName
+			w.WriteHeader(http.StatusOK)
+		}))
+		serverCert := serverCA.issue("127.0.0.1")
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    serverCA.pool(),
+		}
+		server.StartTLS()
+
+		serverCA.writeClientCert("client-1", certFile, keyFile)
+		writeFile(caFile, serverCA.certPEM)
+
+		reloader, err = consumer.NewCertReloader(certFile, keyFile, caFile)
+		Expect(err).ToNot(HaveOccurred())
+
+		cnsmr = consumer.New("wss://"+server.Listener.Addr().String(), reloader.TLSConfig("127.0.0.1"), nil)
+		// Make a new connection, and so a handshake, for every request.
+		cnsmr.SetIdleConnLimits(-1, 0)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("presents the client certificate and verifies the server", func() {
+		_, err := cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(err).To(MatchError(consumer.ErrBadResponse))
+		Expect(clientNames).To(Receive(Equal("client-1")))
+	})
+
+	It("presents a rotated client certificate on new connections", func() {
+		cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(clientNames).To(Receive(Equal("client-1")))
+
+		serverCA.writeClientCert("client-2", certFile, keyFile)
+
+		cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(clientNames).To(Receive(Equal("client-2")))
+	})
+
+	It("verifies the server against a rotated CA bundle", func() {
+		writeFile(caFile, otherCA.certPEM)
+
+		_, err := cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(err).To(HaveOccurred())
+		Expect(err).ToNot(MatchError(consumer.ErrBadResponse))
+		Expect(clientNames).ToNot(Receive())
+
+		writeFile(caFile, append(otherCA.certPEM, serverCA.certPEM...))
+
+		_, err = cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(err).To(MatchError(consumer.ErrBadResponse))
+	})
+
+	It("rejects a server certificate for another name", func() {
+		cnsmr = consumer.New("wss://"+server.Listener.Addr().String(), reloader.TLSConfig("doppler.example.com"), nil)
+
+		_, err := cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(err).To(HaveOccurred())
+		Expect(clientNames).ToNot(Receive())
+	})
+
+	It("rejects a server dialed by IP address when no server name is given", func() {
+		cnsmr = consumer.New("wss://"+server.Listener.Addr().String(), reloader.TLSConfig(""), nil)
+
+		_, err := cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(err).To(HaveOccurred())
+		Expect(err).ToNot(MatchError(consumer.ErrBadResponse))
+		Expect(clientNames).ToNot(Receive())
+	})
+
+	It("keeps the current certificate when a rotated one is invalid", func() {
+		writeFile(certFile, []byte("not a certificate"))
+
+		cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+		Expect(clientNames).To(Receive(Equal("client-1")))
+	})
+
+	It("returns an error when the files cannot be loaded", func() {
+		_, err := consumer.NewCertReloader(filepath.Join(dir, "missing.crt"), keyFile, caFile)
+		Expect(err).To(HaveOccurred())
+
+		writeFile(caFile, []byte("not a certificate"))
+		_, err = consumer.NewCertReloader(certFile, keyFile, caFile)
+		Expect(err).To(HaveOccurred())
+
+		_, err = consumer.NewCertReloader(certFile, "", caFile)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+func newTestCA(name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	return &testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// sign returns PEM encoded certificate and key for name, signed by ca.
+func (ca *testCA) sign(name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if usage == x509.ExtKeyUsageServerAuth {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) issue(name string) tls.Certificate {
+	certPEM, keyPEM := ca.sign(name, x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	Expect(err).ToNot(HaveOccurred())
+	return cert
+}
+
+func (ca *testCA) writeClientCert(name, certFile, keyFile string) {
+	certPEM, keyPEM := ca.sign(name, x509.ExtKeyUsageClientAuth)
+	writeFile(certFile, certPEM)
+	writeFile(keyFile, keyPEM)
+}
+
+// writeFile writes data to name and moves its modification time forward,
+// so that the change is seen even on filesystems with coarse timestamps.
+func writeFile(name string, data []byte) {
+	Expect(ioutil.WriteFile(name, data, 0600)).To(Succeed())
+
+	modTime := time.Now()
+	if info, err := os.Stat(name); err == nil && !info.ModTime().Before(modTime) {
+		modTime = info.ModTime()
+	}
+	modTime = modTime.Add(time.Second)
+	Expect(os.Chtimes(name, modTime, modTime)).To(Succeed())
+}
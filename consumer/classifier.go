@@ -0,0 +1,121 @@
+package consumer
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionFailure describes a failed attempt to open a websocket connection
+// to trafficcontroller.
+type ConnectionFailure struct {
+	// Path is the requested stream path, e.g. "/firehose/subscription-id".
+	Path string
+	// StatusCode is the status of the handshake response, or 0 if no response
+	// was received.
+	StatusCode int
+	// Err is the error returned by the dialer.
+	Err error
+}
+
+// RetryClassifier reports whether a failed connection attempt is worth
+// retrying.  Failures it rejects are returned as NonRetryError, which stops
+// methods such as Firehose and Stream from reconnecting.
+type RetryClassifier func(failure ConnectionFailure) (retry bool)
+
+// DefaultRetryClassifier rejects failures which will not resolve themselves:
+// a 403 Forbidden response, a 404 Not Found response on a firehose path, and
+// TLS certificate verification errors.  Everything else is retried.
+func DefaultRetryClassifier(failure ConnectionFailure) bool {
+	switch failure.StatusCode {
+	case http.StatusForbidden:
+		return false
+	case http.StatusNotFound:
+		if strings.HasPrefix(failure.Path, "/firehose/") {
+			return false
+		}
+	}
+
+	return !isCertificateError(failure.Err)
+}
+
+// SetRetryClassifier sets the function used to decide whether a failed
+// websocket connection attempt should be retried.
+//
+// Defaults to DefaultRetryClassifier.
+func (c *Consumer) SetRetryClassifier(classifier RetryClassifier) {
+	c.classifierLock.Lock()
+	defer c.classifierLock.Unlock()
+	c.retryClassifier = classifier
+}
+
+func (c *Consumer) classify(failure ConnectionFailure) bool {
+	c.classifierLock.RLock()
+	defer c.classifierLock.RUnlock()
+	if c.retryClassifier == nil {
+		return DefaultRetryClassifier(failure)
+	}
+	return c.retryClassifier(failure)
+}
+
+// ReconnectPolicy returns how long to wait before reconnecting after
+// trafficcontroller closed a stream with closeCode.  backoff is the delay
+// which would otherwise be used, and max is the consumer's max retry delay.
+//
+// backoff is the min retry delay after a stream which stayed connected for
+// the max retry delay or longer.  It keeps doubling, up to max, while streams
+// are closed sooner than that after connecting.
+type ReconnectPolicy func(closeCode int, backoff, max time.Duration) time.Duration
+
+// DefaultReconnectPolicy reconnects after a random delay shorter than backoff
+// when the server is going away (e.g. during a deploy), waits for the max
+// retry delay after a policy violation (e.g. a slow consumer being
+// disconnected), and otherwise uses backoff.
+func DefaultReconnectPolicy(closeCode int, backoff, max time.Duration) time.Duration {
+	switch closeCode {
+	case websocket.CloseGoingAway:
+		if backoff <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(backoff)))
+	case websocket.ClosePolicyViolation:
+		return max
+	}
+	return backoff
+}
+
+// SetReconnectPolicy sets the function used to decide how long automatically
+// reconnecting methods (e.g. Firehose, Stream, TailingLogs) wait before
+// reconnecting after trafficcontroller closes the stream.
+//
+// Defaults to DefaultReconnectPolicy.
+func (c *Consumer) SetReconnectPolicy(policy ReconnectPolicy) {
+	c.classifierLock.Lock()
+	defer c.classifierLock.Unlock()
+	c.reconnectPolicy = policy
+}
+
+func (c *Consumer) reconnectDelay(closeCode int, backoff, max time.Duration) time.Duration {
+	c.classifierLock.RLock()
+	defer c.classifierLock.RUnlock()
+	if c.reconnectPolicy == nil {
+		return DefaultReconnectPolicy(closeCode, backoff, max)
+	}
+	return c.reconnectPolicy(closeCode, backoff, max)
+}
+
+func isCertificateError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+	)
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &hostname)
+}
@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// SetCompression sets whether websocket streams ask trafficcontroller for
+// per-message compression (permessage-deflate, RFC 7692).  Compression is
+// only used if trafficcontroller agrees to it; whether it did is reported in
+// the Compressed field of StateConnected events.  Each message is compressed
+// separately, so compression mainly reduces the size of large envelopes,
+// such as multi-line logs; small envelopes may not shrink at all.
+//
+// Compression is disabled by default.
+func (c *Consumer) SetCompression(enabled bool) {
+	c.dialer.EnableCompression = enabled
+}
+
+// dialResult records details of a successful websocket dial, for callers of
+// functions which do not return them.  It is passed down in a context, like
+// an httptrace.ClientTrace.
+type dialResult struct {
+	compressed bool
+}
+
+type dialResultKey struct{}
+
+func withDialResult(ctx context.Context, result *dialResult) context.Context {
+	return context.WithValue(ctx, dialResultKey{}, result)
+}
+
+func recordDialResult(ctx context.Context, resp *http.Response) {
+	if result, ok := ctx.Value(dialResultKey{}).(*dialResult); ok {
+		result.compressed = compressionNegotiated(resp)
+	}
+}
+
+// compressionNegotiated returns true if resp accepts a request for
+// per-message compression.
+func compressionNegotiated(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	for _, header := range resp.Header[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, extension := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.SplitN(extension, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package consumer_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetCompression", func() {
+	var (
+		handler *compressingHandler
+		server  *httptest.Server
+		states  *stateRecorder
+		cnsmr   *consumer.Consumer
+	)
+
+	BeforeEach(func() {
+		handler = newCompressingHandler(true)
+		server = httptest.NewServer(handler)
+		states = &stateRecorder{}
+		cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+		cnsmr.SetStateCallback(states.record)
+	})
+
+	AfterEach(func() {
+		cnsmr.Close()
+		server.Close()
+	})
+
+	connectedEvent := func() consumer.StateEvent {
+		for _, event := range states.events() {
+			if event.State == consumer.StateConnected {
+				return event
+			}
+		}
+		return consumer.StateEvent{}
+	}
+
+	It("does not ask for compression by default", func() {
+		handler.messages <- marshalMessage(createMessage("hello", 0))
+
+		incoming, _ := cnsmr.FirehoseWithoutReconnect("subscription-id", "some-token")
+
+		Eventually(incoming).Should(Receive())
+		Expect(handler.extensions).To(Receive(BeEmpty()))
+		Expect(connectedEvent().Compressed).To(BeFalse())
+	})
+
+	It("negotiates compression when enabled", func() {
+		cnsmr.SetCompression(true)
+		handler.messages <- marshalMessage(createMessage("hello", 0))
+
+		incoming, _ := cnsmr.FirehoseWithoutReconnect("subscription-id", "some-token")
+
+		var envelope *events.Envelope
+		Eventually(incoming).Should(Receive(&envelope))
+		Expect(envelope.GetLogMessage().GetMessage()).To(Equal([]byte("hello")))
+		Expect(handler.extensions).To(Receive(ContainSubstring("permessage-deflate")))
+		Expect(connectedEvent().Compressed).To(BeTrue())
+	})
+
+	It("reports when the server does not support compression", func() {
+		server.Config.Handler = newCompressingHandler(false)
+		cnsmr.SetCompression(true)
+
+		cnsmr.FirehoseWithoutReconnect("subscription-id", "some-token")
+
+		Eventually(func() consumer.StateEvent { return connectedEvent() }).Should(Equal(consumer.StateEvent{
+			State:    consumer.StateConnected,
+			Endpoint: "ws://" + server.Listener.Addr().String(),
+		}))
+	})
+})
+
+// compressingHandler is a websocket server which sends the messages it is
+// given, compressing them if compression is enabled and negotiated.
+type compressingHandler struct {
+	upgrader   websocket.Upgrader
+	messages   chan []byte
+	extensions chan string
+}
+
+func newCompressingHandler(compression bool) *compressingHandler {
+	return &compressingHandler{
+		upgrader: websocket.Upgrader{
+			EnableCompression: compression,
+			CheckOrigin:       func(*http.Request) bool { return true },
+		},
+		messages:   make(chan []byte, 100),
+		extensions: make(chan string, 10),
+	}
+}
+
+func (h *compressingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.extensions <- r.Header.Get("Sec-WebSocket-Extensions")
+	ws, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				ws.Close()
+				return
+			}
+		}
+	}()
+	for message := range h.messages {
+		if err := ws.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			return
+		}
+	}
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// countingListener counts the bytes written to the connections it accepts.
+type countingListener struct {
+	net.Listener
+	written int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, written: &l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+// jsonLogLine is a typical structured application log line.
+const jsonLogLine = `{"timestamp":"2017-01-01T00:00:00.000Z","level":"info","source":"some-app",` +
+	`"message":"request completed","data":{"method":"GET","path":"/v2/apps/some-app-guid/summary",` +
+	`"status":200,"response_time_ms":12,"request_id":"5a3c7b4e-0e5f-4d3a-9c1b-2f6e8d7a9b0c",` +
+	`"user_agent":"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)",` +
+	`"remote_addr":"10.0.16.4:51234","x_forwarded_for":"203.0.113.10, 10.0.16.4"}}`
+
+// stackTraceLog is a multi-line log message, such as an exception's stack
+// trace.
+var stackTraceLog = func() string {
+	trace := "java.lang.IllegalStateException: connection pool exhausted\n"
+	for i := 0; i < 40; i++ {
+		trace += fmt.Sprintf("\tat org.example.service.RequestHandler.handle%d(RequestHandler.java:%d)\n", i, 100+i)
+	}
+	return trace
+}()
+
+func BenchmarkFirehoseCompressed(b *testing.B) {
+	benchmarkFirehose(b, true, jsonLogLine)
+}
+
+func BenchmarkFirehoseUncompressed(b *testing.B) {
+	benchmarkFirehose(b, false, jsonLogLine)
+}
+
+func BenchmarkFirehoseStackTraceCompressed(b *testing.B) {
+	benchmarkFirehose(b, true, stackTraceLog)
+}
+
+func BenchmarkFirehoseStackTraceUncompressed(b *testing.B) {
+	benchmarkFirehose(b, false, stackTraceLog)
+}
+
+// benchmarkFirehose streams b.N log envelopes containing message, and
+// reports the bytes sent by the server for each.  The server compresses
+// with gorilla/websocket's default compression level.
+func benchmarkFirehose(b *testing.B, compression bool, message string) {
+	handler := newCompressingHandler(true)
+	handler.messages = make(chan []byte, b.N)
+	for i := 0; i < b.N; i++ {
+		handler.messages <- marshalMessage(createMessage(message, int64(i)))
+	}
+	close(handler.messages)
+
+	server := httptest.NewUnstartedServer(handler)
+	listener := &countingListener{Listener: server.Listener}
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	cnsmr := consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+	defer cnsmr.Close()
+	cnsmr.SetCompression(compression)
+
+	b.ResetTimer()
+	incoming, errs := cnsmr.FirehoseWithoutReconnect("subscription-id", "some-token")
+	for i := 0; i < b.N; i++ {
+		select {
+		case <-incoming:
+		case err := <-errs:
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&listener.written))/float64(b.N), "wire-bytes/op")
+}
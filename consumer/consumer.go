@@ -22,13 +22,23 @@ var (
 	// KeepAlive sets the interval between keep-alive messages sent by the client to loggregator.
 	KeepAlive = 25 * time.Second
 
-	boundaryRegexp       = regexp.MustCompile("boundary=(.*)")
-	ErrNotOK             = errors.New("unknown issue when making HTTP request to Loggregator")
-	ErrNotFound          = ErrNotOK // NotFound isn't an accurate description of how this is used; please use ErrNotOK instead
-	ErrBadResponse       = errors.New("bad server response")
-	ErrBadRequest        = errors.New("bad client request")
-	ErrLostConnection    = errors.New("remote server terminated connection unexpectedly")
-	ErrMaxRetriesReached = errors.New("maximum number of connection retries reached")
+	boundaryRegexp = regexp.MustCompile("boundary=(.*)")
+
+	// ErrNotOK, ErrBadRequest, ErrBadResponse and ErrLostConnection can be
+	// compared with errors.Is against the kinds in the noaa errors package
+	// (e.g. noaa_errors.ErrServerStatus) as well as against themselves.
+	ErrNotOK       = noaa_errors.NewKindError(noaa_errors.ErrServerStatus, errors.New("unknown issue when making HTTP request to Loggregator"))
+	ErrNotFound    = ErrNotOK // NotFound isn't an accurate description of how this is used; please use ErrNotOK instead
+	ErrBadResponse = noaa_errors.NewKindError(noaa_errors.ErrProtocol, errors.New("bad server response"))
+	ErrBadRequest  = noaa_errors.NewKindError(noaa_errors.ErrServerStatus, errors.New("bad client request"))
+
+	// ErrLostConnection matches (with errors.Is) any error with the
+	// noaa_errors.ERR_LOST_CONNECTION code, which streams return when the
+	// connection is closed abnormally.
+	ErrLostConnection = noaa_errors.NewCodedError(noaa_errors.ERR_LOST_CONNECTION, errors.New("remote server terminated connection unexpectedly"))
+
+	// ErrMaxRetriesReached has the noaa_errors.ERR_MAX_RETRIES code.
+	ErrMaxRetriesReached = noaa_errors.NewCodedError(noaa_errors.ERR_MAX_RETRIES, errors.New("maximum number of connection retries reached"))
 )
 
 //go:generate hel --type DebugPrinter --output mock_debug_printer_test.go
@@ -38,31 +48,42 @@ type DebugPrinter interface {
 	Print(title, dump string)
 }
 
-type nullDebugPrinter struct {
-}
-
-func (nullDebugPrinter) Print(title, body string) {
-}
-
 type RecentPathBuilder func(trafficControllerUrl *url.URL, appGuid string, endpoint string) string
 type StreamPathBuilder func(appGuid string) string
 
 // Consumer represents the actions that can be performed against trafficcontroller.
 // See sync.go and async.go for trafficcontroller access methods.
 type Consumer struct {
-	// minRetryDelay, maxRetryDelay, and maxRetryCount must be the first words in
-	// this struct in order to be used atomically by 32-bit systems.
+	// minRetryDelay, maxRetryDelay, maxRetryCount, syncRetryCount and
+	// failoverThreshold must be the first words in this struct in order to
+	// be used atomically by 32-bit systems.
 	// https://golang.org/src/sync/atomic/doc.go?#L50
-	minRetryDelay, maxRetryDelay, maxRetryCount int64
+	minRetryDelay, maxRetryDelay, maxRetryCount, syncRetryCount, failoverThreshold int64
 
 	trafficControllerUrl string
 	idleTimeout          time.Duration
+	gapDetection         bool
+	rotationBefore       time.Duration
+	rotationOverlap      time.Duration
+	maxFrameSize         int64
+	framePolicy          OversizePolicy
+	maxPartSize          int64
+	partPolicy           OversizePolicy
 	callback             func()
+	stateCallback        func(StateEvent)
 	callbackLock         sync.RWMutex
-	debugPrinter         DebugPrinter
+	retryClassifier      RetryClassifier
+	reconnectPolicy      ReconnectPolicy
+	classifierLock       sync.RWMutex
+	debugPrinter         DebugEventPrinter
+	tracer               Tracer
 	client               *http.Client
+	transport            *http.Transport
 	dialer               websocket.Dialer
+	spreader             *ipSpreader
+	dialContext          DialContextFunc
 
+	endpoints *endpointPool
 	conns     []*connection
 	connsLock sync.Mutex
 
@@ -80,21 +101,21 @@ func New(trafficControllerUrl string, tlsConfig *tls.Config, proxy func(*http.Re
 		proxy = http.ProxyFromEnvironment
 	}
 
+	transport := newTransport(tlsConfig, proxy)
 	return &Consumer{
 		trafficControllerUrl: trafficControllerUrl,
-		debugPrinter:         nullDebugPrinter{},
+		debugPrinter:         nullDebugEventPrinter{},
+		tracer:               noopTracer{},
+		transport:            transport,
 		client: &http.Client{
-			Transport: &http.Transport{
-				Proxy:               proxy,
-				TLSClientConfig:     tlsConfig,
-				TLSHandshakeTimeout: internal.Timeout,
-				DisableKeepAlives:   true,
-			},
-			Timeout: internal.Timeout,
+			Transport: transport,
+			Timeout:   internal.Timeout,
 		},
-		minRetryDelay: int64(DefaultMinRetryDelay),
-		maxRetryDelay: int64(DefaultMaxRetryDelay),
-		maxRetryCount: int64(DefaultMaxRetryCount),
+		minRetryDelay:     int64(DefaultMinRetryDelay),
+		maxRetryDelay:     int64(DefaultMaxRetryDelay),
+		maxRetryCount:     int64(DefaultMaxRetryCount),
+		failoverThreshold: DefaultFailoverThreshold,
+		endpoints:         newEndpointPool([]string{trafficControllerUrl}, RoundRobin),
 		dialer: websocket.Dialer{
 			HandshakeTimeout: internal.Timeout,
 			Proxy:            proxy,
@@ -144,14 +165,14 @@ func checkForErrors(resp *http.Response) *httpError {
 	if resp.StatusCode == http.StatusBadRequest {
 		return &httpError{
 			statusCode: resp.StatusCode,
-			error:      ErrBadRequest,
+			error:      noaa_errors.NewHTTPError(resp, ErrBadRequest),
 		}
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		return &httpError{
 			statusCode: resp.StatusCode,
-			error:      ErrNotOK,
+			error:      noaa_errors.NewHTTPError(resp, ErrNotOK),
 		}
 	}
 	return nil
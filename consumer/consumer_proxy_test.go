@@ -223,6 +223,38 @@ var _ = Describe("Consumer connecting through a Proxy", func() {
 			})
 		})
 
+		Context("with an auth proxy server", func() {
+			var password string
+
+			BeforeEach(func() {
+				messagesToSend <- marshalMessage(createMessage("test-message-0", 0))
+				auth.ProxyBasic(goProxyHandler, "my_realm", func(user, passwd string) bool {
+					return user == "user" && passwd == "password"
+				})
+				password = "password"
+				proxyURL, err := url.Parse(testProxyServer.URL)
+				proxy = func(*http.Request) (*url.URL, error) {
+					proxyURL.User = url.UserPassword("user", password)
+					return proxyURL, err
+				}
+			})
+
+			It("authorizes with the proxy", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(incomingMessages).To(HaveLen(1))
+			})
+
+			Context("with bad credentials", func() {
+				BeforeEach(func() {
+					password = "passwrd"
+				})
+
+				It("returns an error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
 		Context("with a proxy that returns errors", func() {
 			const errMsg = "Invalid proxy URL"
 
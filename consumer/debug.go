@@ -0,0 +1,234 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DebugEventKind identifies the type of a DebugEvent.
+type DebugEventKind string
+
+const (
+	DebugRequest  DebugEventKind = "request"
+	DebugResponse DebugEventKind = "response"
+	DebugError    DebugEventKind = "error"
+	DebugRetry    DebugEventKind = "retry"
+)
+
+// RedactedValue replaces credentials in DebugEvents.
+const RedactedValue = "[PRIVATE DATA HIDDEN]"
+
+// DebugEvent is a structured description of something a Consumer did.
+// Only the fields relevant to its Kind are set.
+//
+// Credentials (e.g. the Authorization header) are redacted before events
+// are passed to a DebugEventPrinter.
+type DebugEvent struct {
+	Kind DebugEventKind
+	// Title is the title passed to a DebugPrinter, e.g. "WEBSOCKET REQUEST".
+	Title string
+	Time  time.Time
+
+	// Request and response fields.
+	Method     string
+	URL        string
+	Proto      string
+	Status     string
+	StatusCode int
+	Header     http.Header
+
+	// Error and retry fields.
+	Err     error
+	Delay   time.Duration
+	Message string
+}
+
+// DebugEventPrinter is a type which handles structured debug events.
+type DebugEventPrinter interface {
+	PrintEvent(event DebugEvent)
+}
+
+// SetDebugEventPrinter sets the consumer to write structured debug events to
+// printer.  It replaces any DebugPrinter set with SetDebugPrinter.
+func (c *Consumer) SetDebugEventPrinter(printer DebugEventPrinter) {
+	c.debugPrinter = printer
+}
+
+func (c *Consumer) debug(event DebugEvent) {
+	event.Time = time.Now()
+	c.debugPrinter.PrintEvent(redactEvent(event))
+}
+
+// legacyDebugPrinter adapts a DebugPrinter to a DebugEventPrinter.  Requests
+// are dumped with only the path in their request line, as a DebugPrinter has
+// always been given.
+type legacyDebugPrinter struct {
+	printer DebugPrinter
+}
+
+func (p legacyDebugPrinter) PrintEvent(event DebugEvent) {
+	event = redactEvent(event)
+	if event.Kind == DebugRequest {
+		if u, err := url.Parse(event.URL); err == nil {
+			event.URL = u.RequestURI()
+		}
+	}
+	p.printer.Print(event.Title, dumpEvent(event))
+}
+
+type nullDebugEventPrinter struct{}
+
+func (nullDebugEventPrinter) PrintEvent(DebugEvent) {}
+
+// dumpEvent formats event as it was printed by a DebugPrinter: HTTP
+// requests and responses as their start line and headers, and errors and
+// retries as their message.
+func dumpEvent(event DebugEvent) string {
+	switch event.Kind {
+	case DebugRequest:
+		return fmt.Sprintf("%s %s %s\n", event.Method, event.URL, event.Proto) + headersString(event.Header)
+	case DebugResponse:
+		return event.Proto + " " + event.Status + "\n" + headersString(event.Header)
+	}
+	if event.Message != "" {
+		return event.Message
+	}
+	if event.Err != nil {
+		return event.Err.Error()
+	}
+	return ""
+}
+
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactEvent returns event with credentials removed from its URL and
+// headers.
+func redactEvent(event DebugEvent) DebugEvent {
+	if event.Header != nil {
+		header := make(http.Header, len(event.Header))
+		for name, values := range event.Header {
+			header[name] = values
+		}
+		for _, name := range redactedHeaders {
+			if _, ok := header[name]; ok {
+				header[name] = []string{RedactedValue}
+			}
+		}
+		event.Header = header
+	}
+
+	if u, err := url.Parse(event.URL); err == nil {
+		changed := false
+		if u.User != nil {
+			u.User = url.User(RedactedValue)
+			changed = true
+		}
+		query := u.Query()
+		for _, name := range []string{"access_token", "token"} {
+			if _, ok := query[name]; ok {
+				query.Set(name, RedactedValue)
+				changed = true
+			}
+		}
+		if changed {
+			u.RawQuery = query.Encode()
+			event.URL = u.String()
+		}
+	}
+	return event
+}
+
+// NewTextDebugPrinter returns a DebugEventPrinter which writes each event
+// to w as its title and time, followed by the same dump a DebugPrinter is
+// given, with credentials redacted.
+func NewTextDebugPrinter(w io.Writer) DebugEventPrinter {
+	return &textDebugPrinter{w: w}
+}
+
+type textDebugPrinter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (p *textDebugPrinter) PrintEvent(event DebugEvent) {
+	event = redactEvent(event)
+	dump := strings.TrimRight(dumpEvent(event), "\n")
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	fmt.Fprintf(p.w, "%s [%s]\n%s\n\n", event.Title, event.Time.Format(time.RFC3339Nano), dump)
+}
+
+// NewJSONDebugPrinter returns a DebugEventPrinter which writes each event to
+// w as a single line of JSON, with credentials redacted.
+func NewJSONDebugPrinter(w io.Writer) DebugEventPrinter {
+	return &jsonDebugPrinter{encoder: json.NewEncoder(w)}
+}
+
+type jsonDebugPrinter struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+type jsonDebugEvent struct {
+	Time       time.Time         `json:"time"`
+	Kind       DebugEventKind    `json:"kind"`
+	Title      string            `json:"title"`
+	Method     string            `json:"method,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Proto      string            `json:"proto,omitempty"`
+	StatusCode int               `json:"status_code,omitempty"`
+	Header     map[string]string `json:"header,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	DelayMS    int64             `json:"delay_ms,omitempty"`
+	Message    string            `json:"message,omitempty"`
+}
+
+func (p *jsonDebugPrinter) PrintEvent(event DebugEvent) {
+	event = redactEvent(event)
+	out := jsonDebugEvent{
+		Time:       event.Time,
+		Kind:       event.Kind,
+		Title:      event.Title,
+		Method:     event.Method,
+		URL:        event.URL,
+		Proto:      event.Proto,
+		StatusCode: event.StatusCode,
+		DelayMS:    int64(event.Delay / time.Millisecond),
+		Message:    event.Message,
+	}
+	if len(event.Header) > 0 {
+		out.Header = make(map[string]string, len(event.Header))
+		for name, values := range event.Header {
+			out.Header[name] = strings.Join(values, ", ")
+		}
+	}
+	if event.Err != nil {
+		out.Error = event.Err.Error()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.encoder.Encode(out)
+}
+
+func headersString(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result string
+	for _, name := range names {
+		result += name + ": " + strings.Join(header[name], ", ") + "\n"
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+//go:build go1.21
+// +build go1.21
+
+package consumer
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// NewSlogDebugPrinter returns a DebugEventPrinter which logs each event to
+// logger at debug level, with its title as the message and its fields as
+// attributes.  Credentials are redacted.
+func NewSlogDebugPrinter(logger *slog.Logger) DebugEventPrinter {
+	return slogDebugPrinter{logger: logger}
+}
+
+type slogDebugPrinter struct {
+	logger *slog.Logger
+}
+
+func (p slogDebugPrinter) PrintEvent(event DebugEvent) {
+	event = redactEvent(event)
+
+	attrs := []slog.Attr{slog.String("kind", string(event.Kind))}
+	if event.Method != "" {
+		attrs = append(attrs, slog.String("method", event.Method))
+	}
+	if event.URL != "" {
+		attrs = append(attrs, slog.String("url", event.URL))
+	}
+	if event.StatusCode != 0 {
+		attrs = append(attrs, slog.Int("status_code", event.StatusCode))
+	}
+	if len(event.Header) > 0 {
+		names := make([]string, 0, len(event.Header))
+		for name := range event.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		header := make([]any, 0, len(names))
+		for _, name := range names {
+			header = append(header, slog.String(name, strings.Join(event.Header[name], ", ")))
+		}
+		attrs = append(attrs, slog.Group("header", header...))
+	}
+	if event.Err != nil {
+		attrs = append(attrs, slog.String("error", event.Err.Error()))
+	}
+	if event.Delay != 0 {
+		attrs = append(attrs, slog.Duration("delay", event.Delay))
+	}
+	if event.Message != "" {
+		attrs = append(attrs, slog.String("detail", event.Message))
+	}
+
+	p.logger.LogAttrs(context.Background(), slog.LevelDebug, event.Title, attrs...)
+}
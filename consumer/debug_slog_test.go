@@ -0,0 +1,47 @@
+//go:build go1.21
+// +build go1.21
+
+package consumer_test
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/cloudfoundry/noaa/consumer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewSlogDebugPrinter", func() {
+	It("logs redacted events at debug level", func() {
+		var buf syncBuffer
+		logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		printer := consumer.NewSlogDebugPrinter(logger)
+
+		printer.PrintEvent(consumer.DebugEvent{
+			Kind:   consumer.DebugRequest,
+			Title:  "WEBSOCKET REQUEST",
+			Method: "GET",
+			URL:    "wss://doppler.example.com/firehose/sub",
+			Header: http.Header{"Authorization": {"bearer secret-token"}},
+		})
+
+		var record map[string]interface{}
+		Expect(json.Unmarshal([]byte(buf.String()), &record)).To(Succeed())
+		Expect(record).To(HaveKeyWithValue("level", "DEBUG"))
+		Expect(record).To(HaveKeyWithValue("msg", "WEBSOCKET REQUEST"))
+		Expect(record).To(HaveKeyWithValue("kind", "request"))
+		Expect(record).To(HaveKeyWithValue("method", "GET"))
+		Expect(record["header"]).To(HaveKeyWithValue("Authorization", consumer.RedactedValue))
+	})
+
+	It("logs nothing when debug logging is disabled", func() {
+		var buf syncBuffer
+		printer := consumer.NewSlogDebugPrinter(slog.New(slog.NewTextHandler(&buf, nil)))
+
+		printer.PrintEvent(consumer.DebugEvent{Kind: consumer.DebugRetry, Title: "WEBSOCKET RETRY"})
+		Expect(buf.String()).To(BeEmpty())
+	})
+})
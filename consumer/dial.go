@@ -0,0 +1,217 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DialContextFunc dials a network address, e.g. through a tunnel.
+// net.Dialer's DialContext method is a DialContextFunc.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// SetDialContext sets the function used to open network connections, both
+// for websocket streams and for sync requests.  If a proxy is in use, dial is
+// used to connect to the proxy.
+//
+// It has no effect on sync requests made with a transport set with
+// SetTransport or SetHTTPClient.
+func (c *Consumer) SetDialContext(dial DialContextFunc) {
+	c.dialContext = dial
+	if transport, ok := c.client.Transport.(*http.Transport); ok && transport == c.transport {
+		transport.DialContext = dial
+	}
+}
+
+// websocketDialer returns the dialer to use to connect to rawURL, and the
+// spreadDial it uses if DNS spreading is enabled.
+//
+// gorilla/websocket only supports HTTP CONNECT proxies, so if the proxy for
+// rawURL is a SOCKS5 proxy, the returned dialer connects through it itself.
+// HTTP CONNECT proxies are left to gorilla/websocket, which authorizes with
+// any credentials in the proxy URL.
+func (c *Consumer) websocketDialer(ctx context.Context, rawURL string) (websocket.Dialer, *spreadDial, error) {
+	dialer := c.dialer
+
+	var deadline time.Time
+	if dialer.HandshakeTimeout != 0 {
+		deadline = time.Now().Add(dialer.HandshakeTimeout)
+	}
+	dial := func(network, addr string) (net.Conn, error) {
+		return c.dial(ctx, deadline, network, addr)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return dialer, nil, err
+	}
+	proxyURL, err := c.proxyFor(u)
+	if err != nil {
+		return dialer, nil, err
+	}
+	if proxyURL != nil && (proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h") {
+		dialer.Proxy = nil
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			conn, err := dial(network, proxyURL.Host)
+			if err != nil {
+				return nil, err
+			}
+			if err := socks5Connect(conn, deadline, proxyURL.User, addr); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+		return dialer, nil, nil
+	}
+
+	var spread *spreadDial
+	if proxyURL == nil && c.spreader != nil {
+		spread = &spreadDial{spreader: c.spreader, ctx: ctx, target: hostPort(u), next: dial}
+		dialer.NetDial = spread.dial
+	} else {
+		dialer.NetDial = dial
+	}
+	return dialer, spread, nil
+}
+
+func (c *Consumer) dial(ctx context.Context, deadline time.Time, network, addr string) (net.Conn, error) {
+	if c.dialContext == nil {
+		dialer := &net.Dialer{Deadline: deadline}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return c.dialContext(ctx, network, addr)
+}
+
+// proxyFor returns the proxy to use for the websocket at u, as gorilla's
+// dialer would look it up.
+func (c *Consumer) proxyFor(u *url.URL) (*url.URL, error) {
+	if c.dialer.Proxy == nil {
+		return nil, nil
+	}
+	httpURL := *u
+	switch u.Scheme {
+	case "ws":
+		httpURL.Scheme = "http"
+	case "wss":
+		httpURL.Scheme = "https"
+	}
+	return c.dialer.Proxy(&http.Request{URL: &httpURL, Header: make(http.Header)})
+}
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn to connect to
+// addr, authorizing with user if it is not nil (RFC 1928, RFC 1929).
+func socks5Connect(conn net.Conn, deadline time.Time, user *url.Userinfo, addr string) error {
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("socks5: invalid port %q", portString)
+	}
+
+	const (
+		noAuth       = 0x00
+		passwordAuth = 0x02
+	)
+	greeting := []byte{0x05, 1, noAuth}
+	if user != nil {
+		greeting = []byte{0x05, 2, noAuth, passwordAuth}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("socks5: unexpected protocol version %d", reply[0])
+	}
+	switch {
+	case reply[1] == noAuth:
+	case reply[1] == passwordAuth && user != nil:
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication methods")
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 0x01)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks5: connect to %s failed with code %d", addr, header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addrLen = int(length[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
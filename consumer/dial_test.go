@@ -0,0 +1,246 @@
+package consumer_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Consumer connecting through a SOCKS5 proxy", func() {
+	var (
+		messagesToSend chan []byte
+		streamServer   *httptest.Server
+		recentServer   *httptest.Server
+		socks          *fakeSOCKS5Proxy
+		proxyUser      *url.Userinfo
+		proxy          func(*http.Request) (*url.URL, error)
+	)
+
+	BeforeEach(func() {
+		messagesToSend = make(chan []byte, 256)
+		streamServer = httptest.NewServer(NewWebsocketHandler(messagesToSend, 100*time.Millisecond))
+		recentServer = httptest.NewServer(NewHttpHandler(messagesToSend))
+
+		socks = newFakeSOCKS5Proxy("user", "password")
+		proxyUser = url.UserPassword("user", "password")
+		proxy = func(*http.Request) (*url.URL, error) {
+			return &url.URL{Scheme: "socks5", Host: socks.addr(), User: proxyUser}, nil
+		}
+	})
+
+	AfterEach(func() {
+		socks.close()
+		streamServer.Close()
+		recentServer.Close()
+	})
+
+	It("streams through the proxy", func() {
+		cnsmr := consumer.New("ws://"+streamServer.Listener.Addr().String(), nil, proxy)
+		defer cnsmr.Close()
+		messagesToSend <- marshalMessage(createMessage("hello", 0))
+
+		incoming, _ := cnsmr.StreamWithoutReconnect("fakeAppGuid", "authToken")
+
+		var message *events.Envelope
+		Eventually(incoming).Should(Receive(&message))
+		Expect(message.GetLogMessage().GetMessage()).To(Equal([]byte("hello")))
+		Expect(socks.targets()).To(ConsistOf(streamServer.Listener.Addr().String()))
+	})
+
+	It("makes sync requests through the proxy", func() {
+		cnsmr := consumer.New("ws://"+recentServer.Listener.Addr().String(), nil, proxy)
+		messagesToSend <- marshalMessage(createMessage("test-message-0", 0))
+		close(messagesToSend)
+
+		messages, err := cnsmr.RecentLogs("fakeAppGuid", "authToken")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		Expect(socks.targets()).To(ConsistOf(recentServer.Listener.Addr().String()))
+	})
+
+	It("sends an error when the proxy rejects the credentials", func() {
+		proxyUser = url.UserPassword("user", "passwrd")
+		cnsmr := consumer.New("ws://"+streamServer.Listener.Addr().String(), nil, proxy)
+		defer cnsmr.Close()
+
+		_, errs := cnsmr.StreamWithoutReconnect("fakeAppGuid", "authToken")
+
+		var err error
+		Eventually(errs).Should(Receive(&err))
+		Expect(err.Error()).To(ContainSubstring("Error dialing trafficcontroller server"))
+		Expect(err.Error()).To(ContainSubstring("authentication failed"))
+		Expect(socks.targets()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("SetDialContext", func() {
+	var (
+		messagesToSend chan []byte
+		server         *httptest.Server
+		dialed         chan string
+		cnsmr          *consumer.Consumer
+	)
+
+	BeforeEach(func() {
+		messagesToSend = make(chan []byte, 256)
+		mux := http.NewServeMux()
+		mux.Handle("/apps/fakeAppGuid/stream", NewWebsocketHandler(messagesToSend, 100*time.Millisecond))
+		mux.Handle("/", NewHttpHandler(messagesToSend))
+		server = httptest.NewServer(mux)
+
+		dialed = make(chan string, 10)
+		cnsmr = consumer.New("ws://doppler.test", nil, func(*http.Request) (*url.URL, error) { return nil, nil })
+		cnsmr.SetDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+		})
+	})
+
+	AfterEach(func() {
+		cnsmr.Close()
+		server.Close()
+	})
+
+	It("dials websocket streams with the function", func() {
+		messagesToSend <- marshalMessage(createMessage("hello", 0))
+
+		incoming, _ := cnsmr.StreamWithoutReconnect("fakeAppGuid", "authToken")
+
+		Eventually(incoming).Should(Receive())
+		Expect(dialed).To(Receive(Equal("doppler.test:80")))
+	})
+
+	It("dials sync requests with the function", func() {
+		close(messagesToSend)
+
+		_, err := cnsmr.RecentLogs("fakeAppGuid", "authToken")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dialed).To(Receive(Equal("doppler.test:80")))
+	})
+})
+
+// fakeSOCKS5Proxy is a SOCKS5 proxy which supports CONNECT requests, and
+// requires username and password authentication.
+type fakeSOCKS5Proxy struct {
+	listener           net.Listener
+	username, password string
+
+	lock      sync.Mutex
+	connected []string
+}
+
+func newFakeSOCKS5Proxy(username, password string) *fakeSOCKS5Proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	p := &fakeSOCKS5Proxy{listener: listener, username: username, password: password}
+	go p.serve()
+	return p
+}
+
+func (p *fakeSOCKS5Proxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *fakeSOCKS5Proxy) close() {
+	p.listener.Close()
+}
+
+func (p *fakeSOCKS5Proxy) targets() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.connected...)
+}
+
+func (p *fakeSOCKS5Proxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *fakeSOCKS5Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil
+		}
+		return buf
+	}
+
+	greeting := read(2)
+	if greeting == nil || greeting[0] != 0x05 {
+		return
+	}
+	methods := read(int(greeting[1]))
+	acceptsPassword := false
+	for _, method := range methods {
+		if method == 0x02 {
+			acceptsPassword = true
+		}
+	}
+	if !acceptsPassword {
+		conn.Write([]byte{0x05, 0xff})
+		return
+	}
+	conn.Write([]byte{0x05, 0x02})
+
+	header := read(2)
+	if header == nil {
+		return
+	}
+	username := string(read(int(header[1])))
+	password := string(read(int(read(1)[0])))
+	if username != p.username || password != p.password {
+		conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	request := read(4)
+	if request == nil || request[1] != 0x01 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 0x01:
+		host = net.IP(read(net.IPv4len)).String()
+	case 0x04:
+		host = net.IP(read(net.IPv6len)).String()
+	case 0x03:
+		host = string(read(int(read(1)[0])))
+	}
+	port := read(2)
+	target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	p.lock.Lock()
+	p.connected = append(p.connected, target)
+	p.lock.Unlock()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
@@ -0,0 +1,160 @@
+package consumer
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultIPCooldown is the default time for which an IP address which failed
+// to connect is avoided when DNS spreading is enabled.
+const DefaultIPCooldown = 30 * time.Second
+
+// Resolver looks up the addresses of a host.  *net.Resolver implements
+// Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SetDNSSpreading makes websocket connections resolve the trafficcontroller
+// host themselves and dial its addresses in turn, rather than leaving the
+// choice of address to the system.  This spreads streams across the
+// trafficcontrollers behind a single hostname.  The TLS server name and Host
+// header are still taken from the trafficcontroller URL.
+//
+// An address which cannot be connected to, or whose trafficcontroller
+// responds with a server error, is avoided by later connections for
+// cooldown, unless every address is being avoided.  resolver may be nil, in
+// which case net.DefaultResolver is used.  Connections through a proxy are
+// not affected, as the proxy resolves the host.
+//
+// DNS spreading is disabled by default.
+func (c *Consumer) SetDNSSpreading(resolver Resolver, cooldown time.Duration) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	c.spreader = newIPSpreader(resolver, cooldown)
+}
+
+// ipSpreader chooses the address to dial for each connection to a host,
+// remembering the addresses which recently failed.
+type ipSpreader struct {
+	resolver Resolver
+	cooldown time.Duration
+
+	lock     sync.Mutex
+	next     map[string]int
+	failures map[string]time.Time
+}
+
+func newIPSpreader(resolver Resolver, cooldown time.Duration) *ipSpreader {
+	return &ipSpreader{
+		resolver: resolver,
+		cooldown: cooldown,
+		next:     make(map[string]int),
+		failures: make(map[string]time.Time),
+	}
+}
+
+// spreadDial is a dial function for a websocket.Dialer which dials an
+// address chosen by the ipSpreader when asked to dial target's host, and
+// otherwise dials normally.  The address dialed is reported through dialed.
+type spreadDial struct {
+	spreader *ipSpreader
+	ctx      context.Context
+	target   string
+	next     func(network, addr string) (net.Conn, error)
+	dialed   string
+}
+
+func (d *spreadDial) dial(network, addr string) (net.Conn, error) {
+	if addr != d.target {
+		return d.next(network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := d.spreader.pick(d.ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	d.dialed = ip
+	return d.next(network, net.JoinHostPort(ip, port))
+}
+
+// done records whether the connection to the address dialed succeeded.
+func (d *spreadDial) done(ok bool) {
+	if d == nil || d.dialed == "" {
+		return
+	}
+	if ok {
+		d.spreader.succeeded(d.dialed)
+		return
+	}
+	d.spreader.failed(d.dialed)
+}
+
+// pick resolves host and returns the next of its addresses which has not
+// recently failed.  If they all have, it returns the one whose failure is
+// oldest.
+func (s *ipSpreader) pick(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	addrs, err := s.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no addresses found", Name: host}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	start := s.next[host]
+	best := start % len(addrs)
+	for i := 0; i < len(addrs); i++ {
+		candidate := (start + i) % len(addrs)
+		failedAt, failed := s.failures[addrs[candidate]]
+		if !failed || now.Sub(failedAt) >= s.cooldown {
+			best = candidate
+			break
+		}
+		if failedAt.Before(s.failures[addrs[best]]) {
+			best = candidate
+		}
+	}
+	s.next[host] = best + 1
+	return addrs[best], nil
+}
+
+func (s *ipSpreader) failed(ip string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures[ip] = time.Now()
+}
+
+func (s *ipSpreader) succeeded(ip string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.failures, ip)
+}
+
+// hostPort returns u's host and port, using the default port for u's scheme
+// if it has none.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "wss", "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,221 @@
+package consumer_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetDNSSpreading", func() {
+	var (
+		handler  *broadcastHandler
+		requests *requestRecorder
+		server   *httptest.Server
+		port     string
+		resolver *fakeResolver
+		tracer   *consumer.RecordingTracer
+		noProxy  func(*http.Request) (*url.URL, error)
+	)
+
+	BeforeEach(func() {
+		handler = newBroadcastHandler()
+		requests = &requestRecorder{handler: handler}
+		resolver = &fakeResolver{}
+		tracer = consumer.NewRecordingTracer()
+		noProxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	})
+
+	JustBeforeEach(func() {
+		_, port, _ = net.SplitHostPort(server.Listener.Addr().String())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	dialedAddresses := func() []interface{} {
+		var addresses []interface{}
+		for _, span := range tracer.SpansNamed(consumer.SpanWebsocketDial) {
+			addresses = append(addresses, span.Attributes["address"])
+		}
+		return addresses
+	}
+
+	Context("with a server on every address", func() {
+		BeforeEach(func() {
+			listener, err := net.Listen("tcp", ":0")
+			Expect(err).ToNot(HaveOccurred())
+			server = httptest.NewUnstartedServer(requests)
+			server.Listener.Close()
+			server.Listener = listener
+			server.Start()
+			resolver.addrs = []string{"127.0.0.1", "127.0.0.2"}
+		})
+
+		It("spreads streams across the resolved addresses, keeping the Host header", func() {
+			cnsmr := consumer.New("ws://doppler.test:"+port, nil, noProxy)
+			defer cnsmr.Close()
+			cnsmr.SetDNSSpreading(resolver, consumer.DefaultIPCooldown)
+
+			cnsmr.Stream("app-1", "some-token")
+			Eventually(handler.tokens).Should(Receive())
+			cnsmr.Stream("app-2", "some-token")
+			Eventually(handler.tokens).Should(Receive())
+
+			Expect(requests.localIPs()).To(ConsistOf("127.0.0.1", "127.0.0.2"))
+			Expect(requests.hosts()).To(ConsistOf("doppler.test:"+port, "doppler.test:"+port))
+			Expect(resolver.lookups()).To(ConsistOf("doppler.test", "doppler.test"))
+		})
+	})
+
+	Context("when an address cannot be connected to", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(requests)
+			resolver.addrs = []string{"127.0.0.2", "127.0.0.1"}
+		})
+
+		It("avoids the address on subsequent retries and streams", func() {
+			cnsmr := consumer.New("ws://doppler.test:"+port, nil, noProxy)
+			defer cnsmr.Close()
+			cnsmr.SetMinRetryDelay(10 * time.Millisecond)
+			cnsmr.SetTracer(tracer)
+			cnsmr.SetDNSSpreading(resolver, time.Minute)
+
+			_, errs := cnsmr.Stream("app-1", "some-token")
+			go func() {
+				for range errs {
+				}
+			}()
+			Eventually(handler.tokens).Should(Receive())
+
+			cnsmr.Stream("app-2", "some-token")
+			Eventually(handler.tokens).Should(Receive())
+
+			Expect(dialedAddresses()).To(Equal([]interface{}{"127.0.0.2", "127.0.0.1", "127.0.0.1"}))
+			Expect(tracer.SpansNamed(consumer.SpanWebsocketDial)[0].Errors).To(HaveLen(1))
+		})
+
+		It("tries the address again once its cooldown has passed", func() {
+			cnsmr := consumer.New("ws://doppler.test:"+port, nil, noProxy)
+			defer cnsmr.Close()
+			cnsmr.SetMinRetryDelay(10 * time.Millisecond)
+			cnsmr.SetTracer(tracer)
+			cnsmr.SetDNSSpreading(resolver, time.Nanosecond)
+
+			_, errs := cnsmr.Stream("app-1", "some-token")
+			go func() {
+				for range errs {
+				}
+			}()
+			Eventually(handler.tokens).Should(Receive())
+
+			_, moreErrs := cnsmr.Stream("app-2", "some-token")
+			go func() {
+				for range moreErrs {
+				}
+			}()
+			Eventually(handler.tokens).Should(Receive())
+
+			Expect(dialedAddresses()).To(Equal([]interface{}{"127.0.0.2", "127.0.0.1", "127.0.0.2", "127.0.0.1"}))
+		})
+	})
+
+	Context("over TLS", func() {
+		var roots *x509.CertPool
+
+		BeforeEach(func() {
+			ca := newTestCA("doppler-ca")
+			server = httptest.NewUnstartedServer(requests)
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue("doppler.test")}}
+			server.StartTLS()
+			resolver.addrs = []string{"127.0.0.1"}
+			roots = ca.pool()
+		})
+
+		It("verifies the server certificate against the host name", func() {
+			cnsmr := consumer.New("wss://doppler.test:"+port, &tls.Config{RootCAs: roots}, noProxy)
+			defer cnsmr.Close()
+			cnsmr.SetDNSSpreading(resolver, consumer.DefaultIPCooldown)
+
+			cnsmr.Stream("app-1", "some-token")
+			Eventually(handler.tokens).Should(Receive())
+			Expect(requests.serverNames()).To(ConsistOf("doppler.test"))
+		})
+	})
+})
+
+type fakeResolver struct {
+	addrs []string
+
+	lock  sync.Mutex
+	hosts []string
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.hosts = append(r.hosts, host)
+	return r.addrs, nil
+}
+
+func (r *fakeResolver) lookups() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.hosts...)
+}
+
+// requestRecorder records how requests reached it before passing them to
+// handler.
+type requestRecorder struct {
+	handler http.Handler
+
+	lock     sync.Mutex
+	requests []*http.Request
+	ips      []string
+}
+
+func (r *requestRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host, _, _ := net.SplitHostPort(req.Context().Value(http.LocalAddrContextKey).(net.Addr).String())
+	r.lock.Lock()
+	r.requests = append(r.requests, req)
+	r.ips = append(r.ips, host)
+	r.lock.Unlock()
+	r.handler.ServeHTTP(w, req)
+}
+
+func (r *requestRecorder) localIPs() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.ips...)
+}
+
+func (r *requestRecorder) hosts() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var hosts []string
+	for _, req := range r.requests {
+		hosts = append(hosts, req.Host)
+	}
+	return hosts
+}
+
+func (r *requestRecorder) serverNames() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var names []string
+	for _, req := range r.requests {
+		names = append(names, req.TLS.ServerName)
+	}
+	return names
+}
@@ -0,0 +1,212 @@
+package consumer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultFailoverThreshold is the default number of consecutive dial
+// failures after which a stream fails over to another endpoint.
+const DefaultFailoverThreshold = 2
+
+// EndpointStrategy decides which endpoint a new connection uses when a
+// Consumer has several trafficcontroller endpoints.
+type EndpointStrategy int
+
+const (
+	// RoundRobin uses each endpoint in turn.
+	RoundRobin EndpointStrategy = iota
+	// HealthWeighted uses the endpoint with the fewest consecutive dial
+	// failures, taking endpoints in turn when several are equally healthy.
+	HealthWeighted
+)
+
+// ConnectionState is the state of a stream's connection.
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateDisconnected
+	// StateFailover means the stream has switched endpoints after repeated
+	// dial failures.
+	StateFailover
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateFailover:
+		return "failover"
+	}
+	return "unknown"
+}
+
+// StateEvent describes a change in the state of a stream's connection.
+type StateEvent struct {
+	State ConnectionState
+	// Endpoint is the trafficcontroller endpoint the stream is using.  For
+	// StateFailover, it is the endpoint being failed over to, and Previous
+	// is the endpoint being abandoned.
+	Endpoint string
+	Previous string
+	// Err is the error which caused a StateDisconnected or StateFailover.
+	Err error
+	// Compressed is true for StateConnected if per-message compression was
+	// negotiated (see SetCompression).
+	Compressed bool
+}
+
+// NewWithEndpoints creates a new consumer which connects to any of
+// trafficControllerUrls.  Each stream and request uses an endpoint chosen by
+// strategy.  Automatically reconnecting streams fail over to another
+// endpoint after repeated dial failures (see SetFailoverThreshold).
+//
+// It returns an error if trafficControllerUrls is empty or contains an
+// invalid URL.
+func NewWithEndpoints(trafficControllerUrls []string, strategy EndpointStrategy, tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error)) (*Consumer, error) {
+	if len(trafficControllerUrls) == 0 {
+		return nil, errors.New("no trafficcontroller endpoints given")
+	}
+	for _, endpoint := range trafficControllerUrls {
+		if _, err := url.ParseRequestURI(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid trafficcontroller endpoint: %w", err)
+		}
+	}
+
+	c := New(trafficControllerUrls[0], tlsConfig, proxy)
+	c.endpoints = newEndpointPool(trafficControllerUrls, strategy)
+	return c, nil
+}
+
+// SetFailoverThreshold sets the number of consecutive dial failures after
+// which an automatically reconnecting stream fails over to another
+// endpoint.  Defaults to DefaultFailoverThreshold.
+func (c *Consumer) SetFailoverThreshold(threshold int) {
+	atomic.StoreInt64(&c.failoverThreshold, int64(threshold))
+}
+
+// SetStateCallback sets a callback function to be called with the state
+// changes of each stream's connection.
+func (c *Consumer) SetStateCallback(cb func(StateEvent)) {
+	c.callbackLock.Lock()
+	defer c.callbackLock.Unlock()
+	c.stateCallback = cb
+}
+
+func (c *Consumer) reportState(event StateEvent) {
+	c.callbackLock.RLock()
+	cb := c.stateCallback
+	c.callbackLock.RUnlock()
+	if cb != nil {
+		cb(event)
+	}
+}
+
+// dialFailed records a failed dial of conn's endpoint, failing conn over to
+// another endpoint if it has failed too many times in a row.
+func (c *Consumer) dialFailed(conn *connection, err error) {
+	c.endpoints.failed(conn.endpoint)
+	conn.dialFailures++
+	if conn.dialFailures < atomic.LoadInt64(&c.failoverThreshold) {
+		return
+	}
+
+	next := c.endpoints.after(conn.endpoint)
+	if next == conn.endpoint {
+		return
+	}
+	c.debug(DebugEvent{
+		Kind:    DebugError,
+		Title:   "WEBSOCKET FAILOVER",
+		URL:     next,
+		Err:     err,
+		Message: "Failing over from " + conn.endpoint + " to " + next,
+	})
+	c.reportState(StateEvent{State: StateFailover, Endpoint: next, Previous: conn.endpoint, Err: err})
+	conn.endpoint = next
+	conn.dialFailures = 0
+}
+
+// endpointPool chooses between trafficcontroller endpoints, tracking the
+// consecutive dial failures of each.
+type endpointPool struct {
+	strategy EndpointStrategy
+
+	lock     sync.Mutex
+	urls     []string
+	failures map[string]int
+	next     int
+}
+
+func newEndpointPool(urls []string, strategy EndpointStrategy) *endpointPool {
+	return &endpointPool{
+		strategy: strategy,
+		urls:     urls,
+		failures: make(map[string]int),
+	}
+}
+
+// pick returns the endpoint for a new connection.
+func (p *endpointPool) pick() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	best := p.next % len(p.urls)
+	if p.strategy == HealthWeighted {
+		for i := 1; i < len(p.urls); i++ {
+			candidate := (p.next + i) % len(p.urls)
+			if p.failures[p.urls[candidate]] < p.failures[p.urls[best]] {
+				best = candidate
+			}
+		}
+	}
+	p.next = best + 1
+	return p.urls[best]
+}
+
+// after returns the endpoint to fail over to from endpoint.
+func (p *endpointPool) after(endpoint string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, u := range p.urls {
+		if u != endpoint {
+			continue
+		}
+		if p.strategy != HealthWeighted {
+			return p.urls[(i+1)%len(p.urls)]
+		}
+		best := (i + 1) % len(p.urls)
+		for j := 2; j < len(p.urls); j++ {
+			candidate := (i + j) % len(p.urls)
+			if p.failures[p.urls[candidate]] < p.failures[p.urls[best]] {
+				best = candidate
+			}
+		}
+		return p.urls[best]
+	}
+	return endpoint
+}
+
+func (p *endpointPool) failed(endpoint string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failures[endpoint]++
+}
+
+func (p *endpointPool) succeeded(endpoint string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.failures, endpoint)
+}
@@ -0,0 +1,188 @@
+package consumer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewWithEndpoints", func() {
+	var (
+		liveHandlers []*broadcastHandler
+		liveServers  []*httptest.Server
+		deadURL      string
+		states       *stateRecorder
+	)
+
+	BeforeEach(func() {
+		liveHandlers = nil
+		liveServers = nil
+		for i := 0; i < 2; i++ {
+			handler := newBroadcastHandler()
+			liveHandlers = append(liveHandlers, handler)
+			liveServers = append(liveServers, httptest.NewServer(handler))
+		}
+
+		dead := httptest.NewServer(http.NotFoundHandler())
+		deadURL = "ws://" + dead.Listener.Addr().String()
+		dead.Close()
+
+		states = &stateRecorder{}
+	})
+
+	AfterEach(func() {
+		for _, server := range liveServers {
+			server.Close()
+		}
+	})
+
+	wsURL := func(server *httptest.Server) string {
+		return "ws://" + server.Listener.Addr().String()
+	}
+
+	It("spreads streams across endpoints round-robin", func() {
+		cnsmr, err := consumer.NewWithEndpoints([]string{wsURL(liveServers[0]), wsURL(liveServers[1])}, consumer.RoundRobin, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer cnsmr.Close()
+
+		cnsmr.Stream("app-1", "some-token")
+		cnsmr.Stream("app-2", "some-token")
+
+		Eventually(liveHandlers[0].tokens).Should(Receive())
+		Eventually(liveHandlers[1].tokens).Should(Receive())
+	})
+
+	It("spreads sync requests across endpoints round-robin", func() {
+		var hits [2]int32
+		for i := range liveServers {
+			i := i
+			liveServers[i].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&hits[i], 1)
+				w.WriteHeader(http.StatusOK)
+			})
+		}
+		cnsmr, err := consumer.NewWithEndpoints([]string{wsURL(liveServers[0]), wsURL(liveServers[1])}, consumer.RoundRobin, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		for i := 0; i < 4; i++ {
+			cnsmr.RecentLogs("some-app-guid", "some-token")
+		}
+		Expect(atomic.LoadInt32(&hits[0])).To(BeEquivalentTo(2))
+		Expect(atomic.LoadInt32(&hits[1])).To(BeEquivalentTo(2))
+	})
+
+	It("fails over to the next endpoint after repeated dial failures", func() {
+		cnsmr, err := consumer.NewWithEndpoints([]string{deadURL, wsURL(liveServers[0])}, consumer.RoundRobin, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer cnsmr.Close()
+		cnsmr.SetMinRetryDelay(10 * time.Millisecond)
+		cnsmr.SetFailoverThreshold(2)
+		cnsmr.SetStateCallback(states.record)
+
+		_, streamErrors := cnsmr.Firehose("subscription-id", "some-token")
+		go func() {
+			for range streamErrors {
+			}
+		}()
+
+		Eventually(liveHandlers[0].tokens).Should(Receive())
+		Eventually(states.events).Should(ContainElement(consumer.StateEvent{
+			State:    consumer.StateConnected,
+			Endpoint: wsURL(liveServers[0]),
+		}))
+
+		events := states.events()
+		Expect(events[0]).To(Equal(consumer.StateEvent{State: consumer.StateConnecting, Endpoint: deadURL}))
+		var failovers []consumer.StateEvent
+		for _, event := range events {
+			if event.State == consumer.StateFailover {
+				failovers = append(failovers, event)
+			}
+		}
+		Expect(failovers).To(HaveLen(1))
+		Expect(failovers[0].Endpoint).To(Equal(wsURL(liveServers[0])))
+		Expect(failovers[0].Previous).To(Equal(deadURL))
+		Expect(failovers[0].Err).To(HaveCode(noaa_errors.ERR_DIAL))
+	})
+
+	It("reports disconnects with the active endpoint", func() {
+		liveServers[0].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+			if ws, err := upgrader.Upgrade(w, r, nil); err == nil {
+				ws.Close()
+			}
+		})
+		cnsmr, err := consumer.NewWithEndpoints([]string{wsURL(liveServers[0])}, consumer.RoundRobin, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		cnsmr.SetStateCallback(states.record)
+
+		_, streamErrors := cnsmr.FirehoseWithoutReconnect("subscription-id", "some-token")
+		Eventually(streamErrors).Should(Receive())
+
+		events := states.events()
+		Expect(events).To(HaveLen(3))
+		Expect(events[1].State).To(Equal(consumer.StateConnected))
+		Expect(events[2].State).To(Equal(consumer.StateDisconnected))
+		Expect(events[2].Endpoint).To(Equal(wsURL(liveServers[0])))
+		Expect(events[2].Err).To(HaveOccurred())
+	})
+
+	It("prefers healthy endpoints when health-weighted", func() {
+		var hits int32
+		liveServers[0].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(http.StatusOK)
+		})
+		cnsmr, err := consumer.NewWithEndpoints([]string{deadURL, wsURL(liveServers[0])}, consumer.HealthWeighted, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		for i := 0; i < 4; i++ {
+			cnsmr.RecentLogs("some-app-guid", "some-token")
+		}
+		Expect(atomic.LoadInt32(&hits)).To(BeEquivalentTo(3))
+	})
+
+	It("names the endpoint which could not be dialed", func() {
+		cnsmr, err := consumer.NewWithEndpoints([]string{wsURL(liveServers[0]), deadURL}, consumer.RoundRobin, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		cnsmr.RecentLogs("some-app-guid", "some-token")
+		_, err = cnsmr.RecentLogs("some-app-guid", "some-token")
+		Expect(err).To(HaveCode(noaa_errors.ERR_DIAL))
+		Expect(err.Error()).To(ContainSubstring("trafficcontroller endpoint is " + deadURL))
+	})
+
+	It("returns an error when no valid endpoints are given", func() {
+		_, err := consumer.NewWithEndpoints(nil, consumer.RoundRobin, nil, nil)
+		Expect(err).To(HaveOccurred())
+
+		_, err = consumer.NewWithEndpoints([]string{"not a url"}, consumer.RoundRobin, nil, nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+type stateRecorder struct {
+	lock   sync.Mutex
+	states []consumer.StateEvent
+}
+
+func (r *stateRecorder) record(event consumer.StateEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.states = append(r.states, event)
+}
+
+func (r *stateRecorder) events() []consumer.StateEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]consumer.StateEvent(nil), r.states...)
+}
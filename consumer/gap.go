@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"context"
+	"time"
+
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// gapTracker records envelope timestamps on either side of a reconnect and
+// reports the window between them as a GapError.  It is only used from the
+// goroutine running retryAction, so it needs no locking.
+type gapTracker struct {
+	conn     *connection
+	last     int64
+	attempts int
+	pending  bool
+}
+
+func newGapTracker(conn *connection) *gapTracker {
+	return &gapTracker{conn: conn}
+}
+
+// track wraps callback so that the first envelope received after a reconnect
+// emits a GapError before being passed on.
+func (t *gapTracker) track(callback func(*events.Envelope)) func(*events.Envelope) {
+	return func(env *events.Envelope) {
+		ts := env.GetTimestamp()
+		if ts == 0 {
+			callback(env)
+			return
+		}
+
+		if t.pending {
+			t.conn.report(noaa_errors.NewGapError(time.Unix(0, t.last), time.Unix(0, ts), t.attempts))
+			t.pending = false
+			t.attempts = 0
+		}
+		t.last = ts
+		callback(env)
+	}
+}
+
+// action wraps a retryAction action so that disconnects and reconnect
+// attempts are counted.
+func (t *gapTracker) action(action func(context.Context) (error, bool)) func(context.Context) (error, bool) {
+	return func(ctx context.Context) (error, bool) {
+		if t.pending {
+			t.attempts++
+		}
+		err, done := action(ctx)
+		if !done && t.last != 0 {
+			t.pending = true
+		}
+		return err, done
+	}
+}
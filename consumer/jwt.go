@@ -0,0 +1,35 @@
+package consumer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// tokenExpiry returns the expiry time in the "exp" claim of a JWT auth token,
+// with or without a "bearer " prefix.  The boolean is false if token is not a
+// JWT or has no expiry.
+func tokenExpiry(token string) (time.Time, bool) {
+	if i := strings.IndexByte(token, ' '); i >= 0 && strings.EqualFold(token[:i], "bearer") {
+		token = strings.TrimSpace(token[i+1:])
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,127 @@
+package consumer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+)
+
+// OversizePolicy decides what happens to a websocket frame or sync response
+// part which is larger than the configured limit.
+type OversizePolicy int
+
+const (
+	// OversizeFail abandons the stream's connection, which is then
+	// reconnected if the stream reconnects automatically, or fails the sync
+	// request.
+	OversizeFail OversizePolicy = iota
+	// OversizeSkip discards the oversized message, without buffering it,
+	// and carries on.  Streams send a *noaa_errors.MessageTooLargeError down
+	// their error channel for each message skipped.
+	OversizeSkip
+)
+
+// SetMaxFrameSize sets the largest websocket message, in bytes, which
+// streams will read, and what to do with larger ones.  Oversized messages
+// are reported as a *noaa_errors.MessageTooLargeError.
+//
+// A size of zero, the default, means there is no limit.
+func (c *Consumer) SetMaxFrameSize(size int64, policy OversizePolicy) {
+	c.maxFrameSize = size
+	c.framePolicy = policy
+}
+
+// SetMaxPartSize sets the largest part of a multipart sync response (e.g.
+// from RecentLogs), in bytes, which will be read, and what to do with
+// larger ones.  With OversizeFail, the request returns a
+// *noaa_errors.MessageTooLargeError.
+//
+// A size of zero, the default, means there is no limit.
+func (c *Consumer) SetMaxPartSize(size int64, policy OversizePolicy) {
+	c.maxPartSize = size
+	c.partPolicy = policy
+}
+
+// readMessage reads the next message from conn's websocket ws, enforcing the
+// maximum frame size and idle timeout.  Skipped frames are reported until
+// stop is closed.
+func (c *Consumer) readMessage(conn *connection, ws *websocket.Conn, stop <-chan struct{}) ([]byte, error) {
+	for {
+		if c.idleTimeout != 0 {
+			ws.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+		if c.maxFrameSize <= 0 {
+			_, data, err := ws.ReadMessage()
+			return data, err
+		}
+
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return nil, err
+		}
+		data, oversized, err := readLimited(r, c.maxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+		if !oversized {
+			return data, nil
+		}
+
+		if c.framePolicy != OversizeSkip {
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+			ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+			ws.Close()
+			return nil, noaa_errors.NewMessageTooLargeError(c.maxFrameSize, false)
+		}
+		tooLarge := noaa_errors.NewMessageTooLargeError(c.maxFrameSize, true)
+		c.debug(DebugEvent{Kind: DebugError, Title: "WEBSOCKET OVERSIZED FRAME", Err: tooLarge})
+		conn.reportUnless(tooLarge, stop)
+	}
+}
+
+// readLimited reads r to the end, returning what it read if that is no more
+// than limit bytes.  Otherwise, it discards the rest of r and returns true.
+func readLimited(r io.Reader, limit int64) ([]byte, bool, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) <= limit {
+		return data, false, nil
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// readPart reads a part of a sync response into a new slice, enforcing the
+// maximum part size.  The returned error is non-nil if the part could not
+// be read or was oversized and the request should fail.  The boolean is
+// true if the part was skipped.
+func (c *Consumer) readPart(r io.Reader, recentPath string, part int) ([]byte, bool, error) {
+	if c.maxPartSize <= 0 {
+		data, err := ioutil.ReadAll(r)
+		return data, false, err
+	}
+	data, oversized, err := readLimited(r, c.maxPartSize)
+	if err != nil || !oversized {
+		return data, false, err
+	}
+	tooLarge := noaa_errors.NewMessageTooLargeError(c.maxPartSize, c.partPolicy == OversizeSkip)
+	c.debug(DebugEvent{
+		Kind:    DebugError,
+		Title:   "HTTP OVERSIZED PART",
+		URL:     recentPath,
+		Err:     tooLarge,
+		Message: fmt.Sprintf("Part %d is larger than %d bytes", part, c.maxPartSize),
+	})
+	if !tooLarge.Skipped {
+		return nil, false, tooLarge
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,133 @@
+package consumer_test
+
+import (
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Size limits", func() {
+	var (
+		small, large []byte
+		cnsmr        *consumer.Consumer
+		server       *httptest.Server
+	)
+
+	BeforeEach(func() {
+		small = marshalMessage(createMessage("small", 0))
+		large = marshalMessage(createMessage(strings.Repeat("x", 2048), 0))
+	})
+
+	AfterEach(func() {
+		cnsmr.Close()
+		server.Close()
+	})
+
+	tooLarge := func(err error) *noaa_errors.MessageTooLargeError {
+		var tooLargeErr *noaa_errors.MessageTooLargeError
+		if errors.As(err, &tooLargeErr) {
+			return tooLargeErr
+		}
+		return nil
+	}
+
+	Describe("SetMaxFrameSize", func() {
+		var handler *compressingHandler
+
+		BeforeEach(func() {
+			handler = newCompressingHandler(false)
+			server = httptest.NewServer(handler)
+			cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+		})
+
+		It("reads frames of any size by default", func() {
+			handler.messages <- large
+
+			incoming, _ := cnsmr.FirehoseWithoutReconnect("subscription-id", "some-token")
+
+			var envelope *events.Envelope
+			Eventually(incoming).Should(Receive(&envelope))
+			Expect(envelope.GetLogMessage().GetMessage()).To(HaveLen(2048))
+		})
+
+		It("skips oversized frames and reports them", func() {
+			cnsmr.SetMaxFrameSize(1024, consumer.OversizeSkip)
+			handler.messages <- small
+			handler.messages <- large
+			handler.messages <- small
+
+			incoming, errs := cnsmr.FirehoseWithoutReconnect("subscription-id", "some-token")
+
+			Eventually(incoming).Should(Receive())
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(tooLarge(err)).To(Equal(noaa_errors.NewMessageTooLargeError(1024, true)))
+			Eventually(incoming).Should(Receive())
+		})
+
+		It("reconnects after an oversized frame", func() {
+			cnsmr.SetMaxFrameSize(1024, consumer.OversizeFail)
+			cnsmr.SetMinRetryDelay(10 * time.Millisecond)
+			handler.messages <- large
+
+			_, errs := cnsmr.Firehose("subscription-id", "some-token")
+
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(tooLarge(err)).To(Equal(noaa_errors.NewMessageTooLargeError(1024, false)))
+			Expect(err).To(BeRetryable())
+			Expect(err).To(HaveKind(noaa_errors.ErrProtocol))
+
+			Eventually(handler.extensions).Should(HaveLen(2))
+		})
+	})
+
+	Describe("SetMaxPartSize", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mp := multipart.NewWriter(w)
+				defer mp.Close()
+				w.Header().Set("Content-Type", `multipart/x-protobuf; boundary=`+mp.Boundary())
+				for _, message := range [][]byte{small, large, small} {
+					part, err := mp.CreatePart(nil)
+					if err != nil {
+						return
+					}
+					part.Write(message)
+				}
+			}))
+			cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+		})
+
+		It("reads parts of any size by default", func() {
+			logs, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(3))
+		})
+
+		It("skips oversized parts", func() {
+			cnsmr.SetMaxPartSize(1024, consumer.OversizeSkip)
+
+			logs, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(2))
+		})
+
+		It("fails the request on an oversized part", func() {
+			cnsmr.SetMaxPartSize(1024, consumer.OversizeFail)
+
+			_, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+			Expect(tooLarge(err)).To(Equal(noaa_errors.NewMessageTooLargeError(1024, false)))
+		})
+	})
+})
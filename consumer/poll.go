@@ -0,0 +1,97 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// PollContainerMetrics calls ContainerEnvelopes for appGuid every interval
+// and sends down the returned channel only those envelopes which are newer
+// than the last envelope seen for the same instance index.
+//
+// Errors (including upstream errors returned by ContainerEnvelopes) are sent
+// down the error channel and polling continues.  Token refresh is handled the
+// same way as ContainerEnvelopes when c has a TokenRefresher.
+//
+// If c is closed, the returned channels will both be closed.  If interval is
+// not positive, an error is sent down the error channel and both channels are
+// closed without polling.
+//
+// Errors must be drained from the returned error channel for polling to
+// continue; if they are not drained, polling will hang.
+func (c *Consumer) PollContainerMetrics(appGuid, authToken string, interval time.Duration) (<-chan *events.Envelope, <-chan error) {
+	return c.PollContainerMetricsWithContext(context.Background(), appGuid, authToken, interval)
+}
+
+// PollContainerMetricsWithContext functions identically to
+// PollContainerMetrics, but also stops polling and closes the returned
+// channels when ctx is done.
+func (c *Consumer) PollContainerMetricsWithContext(ctx context.Context, appGuid, authToken string, interval time.Duration) (<-chan *events.Envelope, <-chan error) {
+	outputs := make(chan *events.Envelope)
+	errors := make(chan error, 1)
+
+	if interval <= 0 {
+		errors <- fmt.Errorf("Invalid poll interval %s", interval)
+		close(errors)
+		close(outputs)
+		return outputs, errors
+	}
+
+	conn := c.newConnContext(ctx)
+	go func() {
+		defer close(errors)
+		defer close(outputs)
+		defer c.removeConn(conn)
+		c.pollContainerEnvelopes(ctx, conn, appGuid, authToken, interval, outputs, errors)
+	}()
+	return outputs, errors
+}
+
+func (c *Consumer) pollContainerEnvelopes(ctx context.Context, conn *connection, appGuid, authToken string, interval time.Duration, outputs chan<- *events.Envelope, errors chan<- error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Share the token between polls, so that a refreshed token is reused
+	// rather than refreshed again on every poll.
+	tokens := &sharedToken{consumer: c, token: authToken}
+	lastSeen := make(map[int32]int64)
+	for {
+		envelopes, err := c.containerEnvelopes(conn.ctx, appGuid, tokens.request)
+		if err != nil {
+			select {
+			case errors <- err:
+			case <-ctx.Done():
+				return
+			case <-conn.done:
+				return
+			}
+		}
+
+		for _, env := range envelopes {
+			index := env.GetContainerMetric().GetInstanceIndex()
+			if last, ok := lastSeen[index]; ok && env.GetTimestamp() <= last {
+				continue
+			}
+			lastSeen[index] = env.GetTimestamp()
+
+			select {
+			case outputs <- env:
+			case <-ctx.Done():
+				return
+			case <-conn.done:
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-conn.done:
+			return
+		}
+	}
+}
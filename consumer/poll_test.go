@@ -0,0 +1,173 @@
+package consumer_test
+
+import (
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PollContainerMetrics", func() {
+	var (
+		cnsmr      *consumer.Consumer
+		testServer *httptest.Server
+		handler    *snapshotHandler
+	)
+
+	BeforeEach(func() {
+		handler = &snapshotHandler{}
+		testServer = httptest.NewServer(handler)
+		cnsmr = consumer.New("ws://"+testServer.Listener.Addr().String(), nil, nil)
+	})
+
+	AfterEach(func() {
+		cnsmr.Close()
+		testServer.Close()
+	})
+
+	It("only sends envelopes with new timestamps per instance", func() {
+		handler.set(createContainerMetric(0, 1000), createContainerMetric(1, 1000))
+
+		envelopes, errs := cnsmr.PollContainerMetrics("app-guid", "auth-token", 50*time.Millisecond)
+
+		Eventually(envelopes).Should(Receive())
+		Eventually(envelopes).Should(Receive())
+		Consistently(envelopes, 200*time.Millisecond).ShouldNot(Receive())
+
+		handler.set(createContainerMetric(0, 1000), createContainerMetric(1, 2000))
+
+		var env *events.Envelope
+		Eventually(envelopes).Should(Receive(&env))
+		Expect(env.GetContainerMetric().GetInstanceIndex()).To(Equal(int32(1)))
+		Expect(env.GetTimestamp()).To(Equal(int64(2000)))
+		Consistently(envelopes, 200*time.Millisecond).ShouldNot(Receive())
+		Expect(errs).ToNot(Receive())
+	})
+
+	It("sends an error and closes both channels when the interval is not positive", func() {
+		envelopes, errs := cnsmr.PollContainerMetrics("app-guid", "auth-token", 0)
+
+		Eventually(errs).Should(Receive(MatchError("Invalid poll interval 0s")))
+		Eventually(errs).Should(BeClosed())
+		Eventually(envelopes).Should(BeClosed())
+	})
+
+	It("sends errors down the error channel and keeps polling", func() {
+		handler.set(createMessage("an error occurred", 1000))
+
+		envelopes, errs := cnsmr.PollContainerMetrics("app-guid", "auth-token", 50*time.Millisecond)
+
+		Eventually(errs).Should(Receive(MatchError("Upstream error: an error occurred")))
+
+		handler.set(createContainerMetric(0, 1000))
+		Eventually(envelopes).Should(Receive())
+	})
+
+	It("closes the channels when the consumer is closed", func() {
+		envelopes, errs := cnsmr.PollContainerMetrics("app-guid", "auth-token", 50*time.Millisecond)
+		Eventually(handler.requestCount).Should(BeNumerically(">", 0))
+
+		Expect(cnsmr.Close()).To(Succeed())
+		Eventually(envelopes).Should(BeClosed())
+		Eventually(errs).Should(BeClosed())
+	})
+
+	It("closes the channels when the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		envelopes, errs := cnsmr.PollContainerMetricsWithContext(ctx, "app-guid", "auth-token", 50*time.Millisecond)
+		Eventually(handler.requestCount).Should(BeNumerically(">", 0))
+
+		cancel()
+		Eventually(envelopes).Should(BeClosed())
+		Eventually(errs).Should(BeClosed())
+	})
+
+	It("forgets the connection once polling stops", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		envelopes, _ := cnsmr.PollContainerMetricsWithContext(ctx, "app-guid", "auth-token", 50*time.Millisecond)
+		Eventually(handler.requestCount).Should(BeNumerically(">", 0))
+
+		cancel()
+		Eventually(envelopes).Should(BeClosed())
+		Eventually(cnsmr.Close).Should(MatchError("connection does not exist"))
+	})
+
+	It("reuses a refreshed token for later polls", func() {
+		refresher := newMockTokenRefresher()
+		refresher.RefreshAuthTokenOutput.Token <- "good-token"
+		refresher.RefreshAuthTokenOutput.AuthError <- nil
+		cnsmr.RefreshTokenFrom(refresher)
+		testServer.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "good-token" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			handler.ServeHTTP(rw, r)
+		})
+
+		_, errs := cnsmr.PollContainerMetrics("app-guid", "expired-token", 50*time.Millisecond)
+
+		Eventually(handler.requestCount).Should(BeNumerically(">", 3))
+		Expect(refresher.RefreshAuthTokenCalled).To(HaveLen(1))
+		Expect(errs).ToNot(Receive())
+	})
+
+	It("abandons a request in progress when the context is done", func() {
+		requests := make(chan struct{}, 10)
+		testServer.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			requests <- struct{}{}
+			<-r.Context().Done()
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		envelopes, errs := cnsmr.PollContainerMetricsWithContext(ctx, "app-guid", "auth-token", 50*time.Millisecond)
+		Eventually(requests).Should(Receive())
+
+		cancel()
+		Eventually(envelopes).Should(BeClosed())
+		Eventually(errs).Should(BeClosed())
+	})
+})
+
+type snapshotHandler struct {
+	mu        sync.Mutex
+	envelopes []*events.Envelope
+	requests  int
+}
+
+func (h *snapshotHandler) set(envelopes ...*events.Envelope) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.envelopes = envelopes
+}
+
+func (h *snapshotHandler) requestCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+func (h *snapshotHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+
+	mp := multipart.NewWriter(rw)
+	defer mp.Close()
+
+	rw.Header().Set("Content-Type", `multipart/x-protobuf; boundary=`+mp.Boundary())
+	for _, env := range h.envelopes {
+		partWriter, err := mp.CreatePart(nil)
+		if err != nil {
+			return
+		}
+		partWriter.Write(marshalMessage(env))
+	}
+}
@@ -0,0 +1,294 @@
+package consumer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+// SetTokenRotation enables proactive re-authentication of streams whose
+// token is a JWT with an expiry, when c has a TokenRefresher.
+//
+// Starting before ahead of the token's expiry, a new token is requested from
+// the TokenRefresher and used to open a replacement websocket.  Once that
+// connects, the old websocket is kept open for overlap and then closed.
+// Envelopes received on both websockets during the overlap are only passed
+// on once.  If the replacement cannot be opened, it is retried with the
+// usual retry delays while the old websocket keeps streaming.
+//
+// Passing a before of zero disables token rotation, which is the default.
+func (c *Consumer) SetTokenRotation(before, overlap time.Duration) {
+	c.rotationBefore = before
+	c.rotationOverlap = overlap
+}
+
+// rotationTime returns when a stream authorized with token should be
+// re-authorized.  The boolean is false if token rotation is disabled, token
+// has no expiry, or token expires too soon to be rotated; such a stream is
+// left to fail and reconnect when its token expires.
+func (c *Consumer) rotationTime(token string) (time.Time, bool) {
+	if c.rotationBefore <= 0 || !c.refreshTokens {
+		return time.Time{}, false
+	}
+	expiry, ok := tokenExpiry(token)
+	if !ok {
+		return time.Time{}, false
+	}
+	rotateAt := expiry.Add(-c.rotationBefore)
+	if time.Until(rotateAt) < c.minRotationInterval() {
+		c.debug(DebugEvent{
+			Kind:    DebugError,
+			Title:   "WEBSOCKET TOKEN ROTATION",
+			Message: fmt.Sprintf("token expires at %s, too soon to rotate %s before expiry; not rotating", expiry.Format(time.RFC3339), c.rotationBefore),
+		})
+		return time.Time{}, false
+	}
+	return rotateAt, true
+}
+
+// minRotationInterval is the shortest time a websocket is used before its
+// token is rotated, so that a refresher handing out short-lived tokens
+// cannot cause a tight loop of rotations.
+func (c *Consumer) minRotationInterval() time.Duration {
+	interval := time.Duration(atomic.LoadInt64(&c.minRetryDelay))
+	if c.rotationOverlap > interval {
+		interval = c.rotationOverlap
+	}
+	return interval
+}
+
+// frame is a message, or the error ending the stream, read from ws.
+type frame struct {
+	ws   *websocket.Conn
+	data []byte
+	err  error
+}
+
+// rotation is the result of opening a replacement websocket.
+type rotation struct {
+	ws    *websocket.Conn
+	token string
+	err   error
+}
+
+func (c *Consumer) readFrames(conn *connection, ws *websocket.Conn, frames chan<- frame, stop <-chan struct{}) {
+	for {
+		data, err := c.readMessage(conn, ws, stop)
+		select {
+		case frames <- frame{ws: ws, data: data, err: err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// listenWithRotation functions like listenForMessages, but replaces the
+// websocket with one using a new token at rotateAt.  It returns the token
+// most recently used, for reconnecting with.
+func (c *Consumer) listenWithRotation(conn *connection, streamPath, token string, rotateAt time.Time, callback func(*events.Envelope)) (string, error) {
+	if conn.closed() {
+		return token, nil
+	}
+
+	// The readers must have finished before returning, as the stream's
+	// error channel may be closed once it ends.
+	var readers sync.WaitGroup
+	defer readers.Wait()
+
+	frames := make(chan frame)
+	stop := make(chan struct{})
+	defer close(stop)
+	read := func(ws *websocket.Conn) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			c.readFrames(conn, ws, frames, stop)
+		}()
+	}
+
+	current := conn.websocket()
+	read(current)
+
+	// Replacements are opened in the background, so that the current
+	// websocket keeps being read while the new token is fetched and the
+	// replacement connects.
+	rotations := make(chan rotation)
+	startRotation := func(token string) {
+		go func() {
+			ws, newToken, err := c.rotateWebsocket(conn, streamPath, token)
+			select {
+			case rotations <- rotation{ws: ws, token: newToken, err: err}:
+			case <-stop:
+				if ws != nil {
+					ws.Close()
+				}
+			}
+		}()
+	}
+
+	var (
+		old     *websocket.Conn
+		overlap <-chan time.Time
+		dedupe  *overlapDeduper
+		backoff time.Duration
+	)
+	defer func() {
+		current.Close()
+		if old != nil {
+			old.Close()
+		}
+	}()
+
+	rotate := time.NewTimer(time.Until(rotateAt))
+	defer rotate.Stop()
+
+	for {
+		select {
+		case <-conn.done:
+			return token, nil
+
+		case <-rotate.C:
+			startRotation(token)
+
+		case r := <-rotations:
+			ws, newToken, err := r.ws, r.token, r.err
+			if err != nil {
+				backoff = c.rotationBackoff(backoff)
+				c.debug(DebugEvent{
+					Kind:    DebugError,
+					Title:   "WEBSOCKET TOKEN ROTATION",
+					Err:     err,
+					Delay:   backoff,
+					Message: fmt.Sprintf("failed: %s\nretrying in %s", err, backoff),
+				})
+				rotate.Reset(backoff)
+				continue
+			}
+			backoff = 0
+
+			conn.setWebsocket(ws)
+			if conn.closed() {
+				ws.Close()
+				return token, nil
+			}
+			if old != nil {
+				old.Close()
+			}
+			old, current = current, ws
+			read(current)
+			overlap = time.After(c.rotationOverlap)
+			dedupe = newOverlapDeduper(old, current)
+
+			// Only rotate again if the new token outlives the old one;
+			// otherwise the old connection is left to fail and reconnect.
+			next, ok := c.rotationTime(newToken)
+			if ok && next.After(rotateAt) {
+				rotateAt = next
+				rotate.Reset(time.Until(rotateAt))
+			}
+			token = newToken
+
+		case <-overlap:
+			old.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			old.Close()
+			old, overlap, dedupe = nil, nil, nil
+
+		case f := <-frames:
+			if conn.closed() {
+				return token, nil
+			}
+			if f.ws != current {
+				if f.ws != old {
+					continue
+				}
+				if f.err != nil {
+					old.Close()
+					old, overlap, dedupe = nil, nil, nil
+					continue
+				}
+			} else if f.err != nil {
+				return token, c.readError(f.err)
+			}
+
+			if dedupe != nil && dedupe.duplicate(f.ws, f.data) {
+				continue
+			}
+
+			envelope := &events.Envelope{}
+			if err := proto.Unmarshal(f.data, envelope); err != nil {
+				continue
+			}
+			callback(envelope)
+		}
+	}
+}
+
+// rotateWebsocket opens a new websocket to streamPath with a freshly
+// refreshed token, discarding token from any token cache.
+func (c *Consumer) rotateWebsocket(conn *connection, streamPath, token string) (*websocket.Conn, string, error) {
+	c.invalidateToken(token)
+	newToken, err := c.getToken(conn.ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	ws, httpErr := c.tryWebsocketConnection(conn.ctx, conn.endpoint, streamPath, newToken)
+	if httpErr != nil {
+		return nil, "", httpErr.error
+	}
+	return ws, newToken, nil
+}
+
+func (c *Consumer) rotationBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if minDelay := time.Duration(atomic.LoadInt64(&c.minRetryDelay)); backoff < minDelay {
+		backoff = minDelay
+	}
+	if maxDelay := time.Duration(atomic.LoadInt64(&c.maxRetryDelay)); backoff > maxDelay {
+		backoff = maxDelay
+	}
+	return backoff
+}
+
+// overlapDeduper drops messages received on one of two websockets which have
+// already been received on the other.
+type overlapDeduper struct {
+	pending map[*websocket.Conn]map[uint64]int
+}
+
+func newOverlapDeduper(a, b *websocket.Conn) *overlapDeduper {
+	return &overlapDeduper{
+		pending: map[*websocket.Conn]map[uint64]int{
+			a: make(map[uint64]int),
+			b: make(map[uint64]int),
+		},
+	}
+}
+
+// duplicate reports whether data, received on ws, matches a message
+// received on the other websocket which has not yet been matched.
+func (d *overlapDeduper) duplicate(ws *websocket.Conn, data []byte) bool {
+	h := fnv.New64a()
+	h.Write(data)
+	sum := h.Sum64()
+
+	for other, pending := range d.pending {
+		if other == ws {
+			continue
+		}
+		if pending[sum] > 0 {
+			pending[sum]--
+			return true
+		}
+	}
+	d.pending[ws][sum]++
+	return false
+}
@@ -0,0 +1,212 @@
+package consumer_test
+
+import (
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetTokenRotation", func() {
+	var (
+		handler   *broadcastHandler
+		server    *httptest.Server
+		refresher *countingTokenRefresher
+		cnsmr     *consumer.Consumer
+	)
+
+	BeforeEach(func() {
+		handler = newBroadcastHandler()
+		server = httptest.NewServer(handler)
+
+		refresher = &countingTokenRefresher{
+			tokens: []string{
+				"bearer " + jwtExpiringIn(4*time.Second),
+				"bearer " + jwtExpiringIn(time.Hour),
+			},
+		}
+
+		cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+		cnsmr.RefreshTokenFrom(refresher)
+	})
+
+	AfterEach(func() {
+		cnsmr.Close()
+		server.Close()
+	})
+
+	Context("when enabled", func() {
+		BeforeEach(func() {
+			cnsmr.SetTokenRotation(2*time.Second, 500*time.Millisecond)
+		})
+
+		It("opens a replacement connection with a new token before the token expires", func() {
+			_, streamErrors := cnsmr.Firehose("subscription-id", "")
+
+			var first, second string
+			Eventually(handler.tokens).Should(Receive(&first))
+			Eventually(handler.tokens, 3).Should(Receive(&second))
+			Expect(second).ToNot(Equal(first))
+			Expect(refresher.count()).To(Equal(2))
+
+			Eventually(handler.closed).Should(Receive(Equal(first)))
+			Consistently(handler.tokens).ShouldNot(Receive())
+			Expect(streamErrors).ToNot(Receive())
+		})
+
+		It("passes on envelopes received on both connections only once", func() {
+			envelopes, _ := cnsmr.Firehose("subscription-id", "")
+			Eventually(handler.tokens).Should(Receive())
+			Eventually(handler.tokens, 3).Should(Receive())
+			Eventually(handler.connections).Should(Equal(2))
+
+			handler.broadcast(marshalMessage(createMessage("during overlap", 1)))
+			Eventually(envelopes).Should(Receive(WithTransform(logText, Equal("during overlap"))))
+			Consistently(envelopes, 200*time.Millisecond).ShouldNot(Receive())
+
+			Eventually(handler.connections).Should(Equal(1))
+			handler.broadcast(marshalMessage(createMessage("after overlap", 2)))
+			Eventually(envelopes).Should(Receive(WithTransform(logText, Equal("after overlap"))))
+		})
+
+		It("stops reading the replaced connection before the stream ends", func() {
+			cnsmr.SetMaxFrameSize(1024, consumer.OversizeSkip)
+			_, streamErrors := cnsmr.FirehoseWithoutReconnect("subscription-id", "")
+			Eventually(handler.tokens).Should(Receive())
+			Eventually(handler.tokens, 3).Should(Receive())
+			Eventually(handler.connections).Should(Equal(2))
+
+			handler.broadcast(marshalMessage(createMessage(strings.Repeat("x", 2048), 1)))
+			handler.disconnect()
+
+			var tooLarge *noaa_errors.MessageTooLargeError
+			for err := range streamErrors {
+				stderrors.As(err, &tooLarge)
+			}
+			Expect(tooLarge).ToNot(BeNil())
+		})
+
+		It("keeps passing on envelopes while the replacement connection is opened", func() {
+			refresher.delay = time.Second
+			envelopes, _ := cnsmr.Firehose("subscription-id", "")
+			Eventually(handler.tokens, 2).Should(Receive())
+			Eventually(refresher.count, 3).Should(Equal(2))
+
+			handler.broadcast(marshalMessage(createMessage("during rotation", 1)))
+			Eventually(envelopes, 500*time.Millisecond).Should(Receive(WithTransform(logText, Equal("during rotation"))))
+			Expect(handler.tokens).ToNot(Receive())
+			Eventually(handler.tokens, 2).Should(Receive())
+		})
+
+		It("reconnects with the rotated token", func() {
+			cnsmr.SetMinRetryDelay(10 * time.Millisecond)
+			cnsmr.Firehose("subscription-id", "")
+
+			var rotated string
+			Eventually(handler.tokens).Should(Receive())
+			Eventually(handler.tokens, 3).Should(Receive(&rotated))
+			Eventually(handler.connections).Should(Equal(1))
+
+			handler.disconnect()
+			Eventually(handler.tokens).Should(Receive(Equal(rotated)))
+			Expect(refresher.count()).To(Equal(2))
+		})
+
+		It("does not rotate tokens which expire within the rotation window", func() {
+			refresher.tokens = []string{"bearer " + jwtExpiringIn(2*time.Second)}
+			cnsmr.Firehose("subscription-id", "")
+
+			Eventually(handler.tokens).Should(Receive())
+			Consistently(handler.tokens, time.Second).ShouldNot(Receive())
+			Expect(refresher.count()).To(Equal(1))
+		})
+	})
+
+	It("is disabled by default", func() {
+		cnsmr.Firehose("subscription-id", "")
+
+		Eventually(handler.tokens).Should(Receive())
+		Consistently(handler.tokens, 2).ShouldNot(Receive())
+	})
+})
+
+func logText(env *events.Envelope) string {
+	return string(env.GetLogMessage().GetMessage())
+}
+
+// broadcastHandler accepts websockets, reporting the token each was opened
+// with, and sends broadcast messages to all of them.
+type broadcastHandler struct {
+	tokens chan string
+	closed chan string
+
+	lock  sync.Mutex
+	conns map[*websocket.Conn]bool
+}
+
+func newBroadcastHandler() *broadcastHandler {
+	return &broadcastHandler{
+		tokens: make(chan string, 10),
+		closed: make(chan string, 10),
+		conns:  make(map[*websocket.Conn]bool),
+	}
+}
+
+func (h *broadcastHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	token := r.Header.Get("Authorization")
+	h.lock.Lock()
+	h.conns[ws] = true
+	h.lock.Unlock()
+	h.tokens <- token
+
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	h.lock.Lock()
+	delete(h.conns, ws)
+	h.lock.Unlock()
+	h.closed <- token
+}
+
+func (h *broadcastHandler) broadcast(data []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for ws := range h.conns {
+		ws.WriteMessage(websocket.BinaryMessage, data)
+	}
+}
+
+// disconnect closes all of the accepted websockets.
+func (h *broadcastHandler) disconnect() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for ws := range h.conns {
+		ws.Close()
+	}
+}
+
+func (h *broadcastHandler) connections() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.conns)
+}
@@ -1,15 +1,20 @@
 package consumer
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudfoundry/noaa"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
 )
@@ -20,11 +25,21 @@ import (
 //
 // The noaa.SortRecent function is provided to sort the data returned by
 // this method.
+//
+// If trafficcontroller responds with an unexpected status code, the error
+// will be a *noaa_errors.HTTPError.
 func (c *Consumer) RecentLogs(appGuid string, authToken string) ([]*events.LogMessage, error) {
-	envelopes, err := c.readTC(appGuid, authToken, "recentlogs")
+	ctx, done := c.newRequestContext(context.Background())
+	defer done()
+	ctx, span := c.tracer.Start(ctx, SpanRecentLogs, Attr("app_guid", appGuid))
+	defer span.End()
+
+	envelopes, err := c.readTC(ctx, appGuid, authToken, "recentlogs")
 	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
+	span.SetAttributes(Attr("envelopes", len(envelopes)))
 	messages := make([]*events.LogMessage, 0, 200)
 	for _, env := range envelopes {
 		messages = append(messages, env.GetLogMessage())
@@ -53,102 +68,375 @@ func (c *Consumer) ContainerMetrics(appGuid string, authToken string) ([]*events
 
 // ContainerEnvelopes connects to trafficcontroller via its 'containermetrics'
 // http(s) endpoint and returns the most recent dropsonde envelopes for an app.
+//
+// If trafficcontroller responds with an unexpected status code, the error
+// will be a *noaa_errors.HTTPError.  If it responds with an error in place of
+// the metrics, it is returned as a *noaa_errors.UpstreamError.
 func (c *Consumer) ContainerEnvelopes(appGuid, authToken string) ([]*events.Envelope, error) {
-	envelopes, err := c.readTC(appGuid, authToken, "containermetrics")
-	if err != nil {
-		return nil, err
+	ctx, done := c.newRequestContext(context.Background())
+	defer done()
+	return c.containerEnvelopes(ctx, appGuid, c.requestWithToken(authToken))
+}
+
+func (c *Consumer) containerEnvelopes(ctx context.Context, appGuid string, request func(ctx context.Context, tcEndpoint, path string) (*http.Response, error)) ([]*events.Envelope, error) {
+	ctx, span := c.tracer.Start(ctx, SpanContainerEnvelopes, Attr("app_guid", appGuid))
+	defer span.End()
+
+	envelopes, err := c.readTCWith(ctx, appGuid, "containermetrics", request)
+	if err == nil {
+		envelopes, err = checkUpstreamErrors(envelopes)
+	}
+	span.RecordError(err)
+	span.SetAttributes(Attr("envelopes", len(envelopes)))
+	return envelopes, err
+}
+
+// ContainerEnvelopesMulti calls ContainerEnvelopes for each of appGuids,
+// running at most concurrency requests at a time.  The results and errors are
+// keyed by app guid; each app guid appears in exactly one of the two maps.
+//
+// When c has a TokenRefresher, the token is shared between the workers: an
+// empty authToken or a 401 response results in a single refresh, whose token
+// is then used for all following requests.
+func (c *Consumer) ContainerEnvelopesMulti(appGuids []string, authToken string, concurrency int) (map[string][]*events.Envelope, map[string]error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		results = make(map[string][]*events.Envelope, len(appGuids))
+		errs    = make(map[string]error)
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+	)
+
+	ctx, done := c.newRequestContext(context.Background())
+	defer done()
+
+	tokens := &sharedToken{consumer: c, token: authToken}
+	appGuidsChan := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for appGuid := range appGuidsChan {
+				envelopes, err := c.containerEnvelopes(ctx, appGuid, tokens.request)
+
+				lock.Lock()
+				if err != nil {
+					errs[appGuid] = err
+				} else {
+					results[appGuid] = envelopes
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, appGuid := range appGuids {
+		appGuidsChan <- appGuid
 	}
+	close(appGuidsChan)
+	wg.Wait()
+
+	return results, errs
+}
+
+func checkUpstreamErrors(envelopes []*events.Envelope) ([]*events.Envelope, error) {
 	for _, env := range envelopes {
 		if env.GetEventType() == events.Envelope_LogMessage {
-			return nil, errors.New(fmt.Sprintf("Upstream error: %s", env.GetLogMessage().GetMessage()))
+			msg := env.GetLogMessage()
+			return nil, noaa_errors.NewUpstreamError(string(msg.GetMessage()), msg.GetSourceType(), time.Unix(0, msg.GetTimestamp()))
 		}
 	}
 	return envelopes, nil
 }
 
-func (c *Consumer) readTC(appGuid string, authToken string, endpoint string) ([]*events.Envelope, error) {
-	trafficControllerUrl, err := url.ParseRequestURI(c.trafficControllerUrl)
+func (c *Consumer) readTC(ctx context.Context, appGuid string, authToken string, endpoint string) ([]*events.Envelope, error) {
+	return c.readTCWith(ctx, appGuid, endpoint, c.requestWithToken(authToken))
+}
+
+// requestWithToken returns a request function for readTCWith which
+// authorizes with authToken, refreshing it if it is empty or rejected.
+func (c *Consumer) requestWithToken(authToken string) func(ctx context.Context, tcEndpoint, path string) (*http.Response, error) {
+	return func(ctx context.Context, tcEndpoint, path string) (*http.Response, error) {
+		return c.requestTC(ctx, tcEndpoint, path, authToken)
+	}
+}
+
+func (c *Consumer) readTCWith(ctx context.Context, appGuid, endpoint string, request func(ctx context.Context, tcEndpoint, path string) (*http.Response, error)) ([]*events.Envelope, error) {
+	tcEndpoint := c.endpoints.pick()
+	trafficControllerUrl, err := url.ParseRequestURI(tcEndpoint)
 	if err != nil {
 		return nil, err
 	}
 
 	recentPath := c.recentPathBuilder(trafficControllerUrl, appGuid, endpoint)
 
-	resp, err := c.requestTC(recentPath, authToken)
+	resp, err := c.requestWithRetries(ctx, tcEndpoint, recentPath, request)
 	if err != nil {
+		if isEndpointFailure(err) {
+			c.endpoints.failed(tcEndpoint)
+		}
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
+	c.endpoints.succeeded(tcEndpoint)
 
 	reader, err := getMultipartReader(resp)
 	if err != nil {
+		c.debug(DebugEvent{
+			Kind:    DebugError,
+			Title:   "HTTP ERROR",
+			URL:     recentPath,
+			Err:     err,
+			Message: fmt.Sprintf("Invalid multipart Content-Type %q", resp.Header.Get("Content-Type")),
+		})
 		return nil, err
 	}
 
-	var buffer bytes.Buffer
+	var (
+		envelopes      []*events.Envelope
+		parts          int
+		decodeFailures int
+		oversizedParts int
+		part           *multipart.Part
+		loopErr        error
+	)
+	for part, loopErr = reader.NextPart(); loopErr == nil; part, loopErr = reader.NextPart() {
+		parts++
 
-	var envelopes []*events.Envelope
-	for part, loopErr := reader.NextPart(); loopErr == nil; part, loopErr = reader.NextPart() {
-		buffer.Reset()
-
-		_, err = buffer.ReadFrom(part)
+		data, skipped, err := c.readPart(part, recentPath, parts)
+		var tooLarge *noaa_errors.MessageTooLargeError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
 		if err != nil {
+			loopErr = err
 			break
 		}
+		if skipped {
+			oversizedParts++
+			continue
+		}
 
 		envelope := new(events.Envelope)
-		if err := proto.Unmarshal(buffer.Bytes(), envelope); err != nil {
+		if err := proto.Unmarshal(data, envelope); err != nil {
+			decodeFailures++
+			c.debug(DebugEvent{
+				Kind:    DebugError,
+				Title:   "HTTP DECODE ERROR",
+				URL:     recentPath,
+				Err:     err,
+				Message: fmt.Sprintf("Failed to decode part %d (%d bytes): %s", parts, len(data), err),
+			})
 			continue
 		}
 
 		envelopes = append(envelopes, envelope)
 	}
 
+	summary := fmt.Sprintf("Content-Type: %s\nParts: %d\nEnvelopes: %d\nDecode failures: %d",
+		resp.Header.Get("Content-Type"), parts, len(envelopes), decodeFailures)
+	if oversizedParts > 0 {
+		summary += fmt.Sprintf("\nOversized parts: %d", oversizedParts)
+	}
+	if loopErr != io.EOF {
+		summary += fmt.Sprintf("\nRead error: %s", loopErr)
+	}
+	c.debug(DebugEvent{
+		Kind:       DebugResponse,
+		Title:      "HTTP RESPONSE BODY",
+		URL:        recentPath,
+		StatusCode: resp.StatusCode,
+		Message:    summary,
+	})
+
 	return envelopes, nil
 }
 
-func (c *Consumer) requestTC(path, authToken string) (*http.Response, error) {
+// requestWithRetries calls request, retrying up to c's sync retry count when
+// the traffic controller asks for a retry with a Retry-After header.
+func (c *Consumer) requestWithRetries(ctx context.Context, tcEndpoint, path string, request func(ctx context.Context, tcEndpoint, path string) (*http.Response, error)) (*http.Response, error) {
+	retries := atomic.LoadInt64(&c.syncRetryCount)
+	for attempt := int64(0); ; attempt++ {
+		resp, err := request(ctx, tcEndpoint, path)
+		retryAfter, ok := retryAfterHint(err)
+		if !ok || attempt >= retries {
+			return resp, err
+		}
+		delay := c.capRetryAfter(retryAfter)
+		c.debug(DebugEvent{
+			Kind:    DebugRetry,
+			Title:   "HTTP RETRY",
+			URL:     path,
+			Err:     err,
+			Delay:   delay,
+			Message: fmt.Sprintf("Server requested a delay of %s", retryAfter),
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Consumer) requestTC(ctx context.Context, tcEndpoint, path, authToken string) (*http.Response, error) {
 	if authToken == "" && c.refreshTokens {
-		return c.requestTCNewToken(path)
+		return c.requestTCNewToken(ctx, tcEndpoint, path)
 	}
 	var err error
-	resp, httpErr := c.tryTCConnection(path, authToken)
+	resp, httpErr := c.tryTCConnection(ctx, tcEndpoint, path, authToken)
 	if httpErr != nil {
 		err = httpErr.error
 		if httpErr.statusCode == http.StatusUnauthorized && c.refreshTokens {
-			resp, err = c.requestTCNewToken(path)
+			c.invalidateToken(authToken)
+			resp, err = c.requestTCNewToken(ctx, tcEndpoint, path)
 		}
 	}
 	return resp, err
 }
 
-func (c *Consumer) requestTCNewToken(path string) (*http.Response, error) {
-	token, err := c.getToken()
+func (c *Consumer) requestTCNewToken(ctx context.Context, tcEndpoint, path string) (*http.Response, error) {
+	token, err := c.getToken(ctx)
 	if err != nil {
 		return nil, err
 	}
-	conn, httpErr := c.tryTCConnection(path, token)
+	conn, httpErr := c.tryTCConnection(ctx, tcEndpoint, path, token)
 	if httpErr != nil {
 		return nil, httpErr.error
 	}
 	return conn, nil
 }
 
-func (c *Consumer) tryTCConnection(recentPath, token string) (*http.Response, *httpError) {
-	req, _ := http.NewRequest("GET", recentPath, nil)
+func (c *Consumer) tryTCConnection(ctx context.Context, tcEndpoint, recentPath, token string) (*http.Response, *httpError) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", recentPath, nil)
 	req.Header.Set("Authorization", token)
 
+	c.debug(DebugEvent{
+		Kind:   DebugRequest,
+		Title:  "HTTP REQUEST",
+		Method: req.Method,
+		URL:    recentPath,
+		Proto:  req.Proto,
+		Header: req.Header,
+	})
+
 	resp, err := c.client.Do(req)
 	if err != nil {
-		message := `Error dialing trafficcontroller server: %s.
+		message := `Error dialing trafficcontroller server: %w.
 Please ask your Cloud Foundry Operator to check the platform configuration (trafficcontroller endpoint is %s).`
+		err = noaa_errors.NewCodedError(noaa_errors.ERR_DIAL, fmt.Errorf(message, err, tcEndpoint))
+		c.debug(DebugEvent{Kind: DebugError, Title: "HTTP ERROR", URL: recentPath, Err: err})
 		return nil, &httpError{
 			statusCode: -1,
-			error:      errors.New(fmt.Sprintf(message, err, c.trafficControllerUrl)),
+			error:      err,
+		}
+	}
+
+	c.debug(DebugEvent{
+		Kind:       DebugResponse,
+		Title:      "HTTP RESPONSE",
+		URL:        recentPath,
+		Proto:      resp.Proto,
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	})
+
+	if httpErr := checkForErrors(resp); httpErr != nil {
+		drainAndClose(resp.Body)
+		return nil, httpErr
+	}
+	return resp, nil
+}
+
+// sharedToken lets several concurrent requests share a single auth token,
+// refreshing it at most once for each token that is rejected.
+type sharedToken struct {
+	consumer *Consumer
+
+	lock       sync.Mutex
+	token      string
+	generation int
+	err        error
+	refreshing chan struct{}
+}
+
+func (s *sharedToken) current() (string, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.token, s.generation, s.err
+}
+
+// refresh fetches a new token, unless the token from generation has already
+// been replaced by another worker, in which case that replacement is used.
+// Workers which ask while a refresh is in progress wait for its result.  A
+// failed refresh is returned to those workers, but a worker which asks
+// afterwards tries again.
+func (s *sharedToken) refresh(ctx context.Context, generation int) (string, int, error) {
+	s.lock.Lock()
+	for generation == s.generation && s.refreshing != nil {
+		refreshing := s.refreshing
+		s.lock.Unlock()
+		select {
+		case <-refreshing:
+		case <-ctx.Done():
+			return "", generation, ctx.Err()
 		}
+		s.lock.Lock()
+	}
+	if generation != s.generation {
+		defer s.lock.Unlock()
+		return s.token, s.generation, s.err
 	}
+	refreshing := make(chan struct{})
+	s.refreshing = refreshing
+	s.lock.Unlock()
 
-	return resp, checkForErrors(resp)
+	token, err := s.consumer.getToken(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.token, s.err = token, err
+	s.generation++
+	s.refreshing = nil
+	close(refreshing)
+	return s.token, s.generation, s.err
+}
+
+func (s *sharedToken) request(ctx context.Context, tcEndpoint, path string) (*http.Response, error) {
+	refreshTokens := s.consumer.refreshTokens
+	token, generation, err := s.current()
+	if err != nil || (token == "" && refreshTokens) {
+		token, generation, err = s.refresh(ctx, generation)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, httpErr := s.consumer.tryTCConnection(ctx, tcEndpoint, path, token)
+	if httpErr == nil {
+		return resp, nil
+	}
+	if httpErr.statusCode != http.StatusUnauthorized || !refreshTokens {
+		return nil, httpErr.error
+	}
+
+	s.consumer.invalidateToken(token)
+	token, _, err = s.refresh(ctx, generation)
+	if err != nil {
+		return nil, err
+	}
+	resp, httpErr = s.consumer.tryTCConnection(ctx, tcEndpoint, path, token)
+	if httpErr != nil {
+		return nil, httpErr.error
+	}
+	return resp, nil
 }
 
 func getMultipartReader(resp *http.Response) (*multipart.Reader, error) {
@@ -1,15 +1,22 @@
 package consumer_test
 
 import (
+	"context"
 	"crypto/tls"
+	stderrors "errors"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/noaa/errors"
 	"github.com/cloudfoundry/noaa/test_helpers"
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
 
 	"net/url"
 
@@ -85,6 +92,18 @@ var _ = Describe("Consumer (Synchronous)", func() {
 			})
 		})
 
+		Context("when the server cannot be reached", func() {
+			BeforeEach(func() {
+				server := httptest.NewServer(http.NotFoundHandler())
+				trafficControllerURL = "ws://" + server.Listener.Addr().String()
+				server.Close()
+			})
+
+			It("returns an error of the dial kind", func() {
+				Expect(recentError).To(HaveKind(errors.ErrDial))
+			})
+		})
+
 		Context("when the connection can be established", func() {
 			BeforeEach(func() {
 				testServer = httptest.NewServer(NewHttpHandler(messagesToSend))
@@ -181,7 +200,9 @@ var _ = Describe("Consumer (Synchronous)", func() {
 			BeforeEach(func() {
 				serverMux := http.NewServeMux()
 				serverMux.HandleFunc("/apps/appGuid/recentlogs", func(resp http.ResponseWriter, req *http.Request) {
+					resp.Header().Set("Retry-After", "30")
 					resp.WriteHeader(http.StatusNotFound)
+					resp.Write([]byte("no such app"))
 				})
 				testServer = httptest.NewServer(serverMux)
 				trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
@@ -189,7 +210,19 @@ var _ = Describe("Consumer (Synchronous)", func() {
 
 			It("returns a not found reponse error message", func() {
 				Expect(recentError).To(HaveOccurred())
-				Expect(recentError).To(Equal(consumer.ErrNotFound))
+				Expect(stderrors.Is(recentError, consumer.ErrNotFound)).To(BeTrue())
+			})
+
+			It("returns an HTTPError with the response details", func() {
+				var httpErr *errors.HTTPError
+				Expect(stderrors.As(recentError, &httpErr)).To(BeTrue())
+				Expect(httpErr.StatusCode).To(Equal(http.StatusNotFound))
+				Expect(httpErr.Header.Get("Retry-After")).To(Equal("30"))
+				Expect(string(httpErr.Body)).To(Equal("no such app"))
+			})
+
+			It("returns an error of the server status kind", func() {
+				Expect(recentError).To(HaveKind(errors.ErrServerStatus))
 			})
 
 		})
@@ -210,6 +243,10 @@ var _ = Describe("Consumer (Synchronous)", func() {
 				Expect(recentError.Error()).To(ContainSubstring("You are not authorized. Helpful message"))
 				Expect(recentError).To(BeAssignableToTypeOf(&errors.UnauthorizedError{}))
 			})
+
+			It("returns an error of the auth kind", func() {
+				Expect(recentError).To(HaveKind(errors.ErrAuth))
+			})
 		})
 
 		Context("when a recent path builder is provided", func() {
@@ -251,6 +288,103 @@ var _ = Describe("Consumer (Synchronous)", func() {
 		})
 	})
 
+	Describe("SetSyncRetryCount", func() {
+		var (
+			failures int
+			requests int
+		)
+
+		BeforeEach(func() {
+			appGuid = "appGuid"
+			failures = 2
+			requests = 0
+
+			serverMux := http.NewServeMux()
+			serverMux.HandleFunc("/apps/appGuid/recentlogs", func(resp http.ResponseWriter, req *http.Request) {
+				requests++
+				if requests <= failures {
+					resp.Header().Set("Retry-After", "0")
+					resp.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				NewHttpHandler(messagesToSend).ServeHTTP(resp, req)
+			})
+			testServer = httptest.NewServer(serverMux)
+			trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+
+			messagesToSend <- marshalMessage(createMessage("test-message", 0))
+			close(messagesToSend)
+		})
+
+		It("does not retry by default", func() {
+			_, err := cnsmr.RecentLogs(appGuid, authToken)
+
+			var httpErr *errors.HTTPError
+			Expect(stderrors.As(err, &httpErr)).To(BeTrue())
+			Expect(httpErr.StatusCode).To(Equal(http.StatusTooManyRequests))
+			Expect(requests).To(Equal(1))
+		})
+
+		It("retries requests which are rejected with Retry-After", func() {
+			cnsmr.SetSyncRetryCount(2)
+
+			messages, err := cnsmr.RecentLogs(appGuid, authToken)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(requests).To(Equal(3))
+		})
+
+		It("gives up after the retry count", func() {
+			cnsmr.SetSyncRetryCount(1)
+
+			_, err := cnsmr.RecentLogs(appGuid, authToken)
+
+			Expect(err).To(HaveOccurred())
+			Expect(requests).To(Equal(2))
+		})
+
+		Context("when the traffic controller asks for a long delay", func() {
+			BeforeEach(func() {
+				failures = 1
+				serverMux := http.NewServeMux()
+				serverMux.HandleFunc("/apps/appGuid/", func(resp http.ResponseWriter, req *http.Request) {
+					requests++
+					if requests <= failures {
+						resp.Header().Set("Retry-After", "30")
+						resp.WriteHeader(http.StatusTooManyRequests)
+						return
+					}
+					NewHttpHandler(messagesToSend).ServeHTTP(resp, req)
+				})
+				testServer.Config.Handler = serverMux
+			})
+
+			It("waits no longer than the max retry delay", func() {
+				cnsmr.SetSyncRetryCount(1)
+				cnsmr.SetMaxRetryDelay(100 * time.Millisecond)
+
+				start := time.Now()
+				_, err := cnsmr.RecentLogs(appGuid, authToken)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+				Expect(requests).To(Equal(2))
+			})
+
+			It("stops waiting when the context is done", func() {
+				cnsmr.SetSyncRetryCount(1)
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				_, errs := cnsmr.PollContainerMetricsWithContext(ctx, appGuid, authToken, time.Hour)
+
+				Consistently(errs, 200*time.Millisecond).ShouldNot(Receive())
+				cancel()
+				Eventually(errs, 500*time.Millisecond).Should(BeClosed())
+				Expect(requests).To(Equal(1))
+			})
+		})
+	})
+
 	Describe("ContainerMetrics", func() {
 		var handler *HttpHandler
 
@@ -330,6 +464,26 @@ var _ = Describe("Consumer (Synchronous)", func() {
 					Expect(err).To(HaveOccurred())
 					Expect(err).To(MatchError("Upstream error: an error occurred"))
 				})
+
+				It("returns a retryable UpstreamError with the message details", func() {
+					Expect(err).To(BeAssignableToTypeOf(&errors.UpstreamError{}))
+					upstreamErr := err.(*errors.UpstreamError)
+					Expect(upstreamErr.Message).To(Equal("an error occurred"))
+					Expect(upstreamErr.SourceType).To(Equal("DEA"))
+					Expect(upstreamErr.Timestamp).To(Equal(time.Unix(0, 2000)))
+					Expect(upstreamErr.Retryable()).To(BeTrue())
+				})
+			})
+
+			Context("when trafficcontroller reports that the app is not found", func() {
+				BeforeEach(func() {
+					messagesToSend <- marshalMessage(createMessage("App not found", 2000))
+				})
+
+				It("returns an UpstreamError which is not retryable", func() {
+					Expect(err).To(BeAssignableToTypeOf(&errors.UpstreamError{}))
+					Expect(err.(*errors.UpstreamError).Retryable()).To(BeFalse())
+				})
 			})
 		})
 
@@ -424,7 +578,8 @@ var _ = Describe("Consumer (Synchronous)", func() {
 			It("returns a not found reponse error message", func() {
 
 				Expect(err).To(HaveOccurred())
-				Expect(err).To(Equal(consumer.ErrNotFound))
+				Expect(stderrors.Is(err, consumer.ErrNotFound)).To(BeTrue())
+				Expect(err).To(BeAssignableToTypeOf(&errors.HTTPError{}))
 			})
 
 		})
@@ -448,4 +603,143 @@ var _ = Describe("Consumer (Synchronous)", func() {
 			})
 		})
 	})
+
+	Describe("ContainerEnvelopesMulti", func() {
+		var (
+			handler *multiAppHandler
+			appIDs  []string
+		)
+
+		BeforeEach(func() {
+			handler = &multiAppHandler{validToken: "good-token"}
+			testServer = httptest.NewServer(handler)
+			trafficControllerURL = "ws://" + testServer.Listener.Addr().String()
+			authToken = "good-token"
+
+			appIDs = nil
+			for i := 0; i < 20; i++ {
+				appIDs = append(appIDs, fmt.Sprintf("app-%d", i))
+			}
+		})
+
+		It("returns envelopes for each app", func() {
+			results, errs := cnsmr.ContainerEnvelopesMulti(appIDs, authToken, 4)
+
+			Expect(errs).To(BeEmpty())
+			Expect(results).To(HaveLen(20))
+			for _, appID := range appIDs {
+				Expect(results[appID]).To(HaveLen(1))
+				Expect(results[appID][0].GetContainerMetric().GetApplicationId()).To(Equal(appID))
+			}
+		})
+
+		It("does not exceed the concurrency limit", func() {
+			cnsmr.ContainerEnvelopesMulti(appIDs, authToken, 3)
+
+			Expect(handler.maxInFlight()).To(BeNumerically("<=", 3))
+			Expect(handler.maxInFlight()).To(BeNumerically(">", 1))
+		})
+
+		It("returns per-app errors", func() {
+			appIDs = append(appIDs, "upstream-error")
+
+			results, errs := cnsmr.ContainerEnvelopesMulti(appIDs, authToken, 4)
+
+			Expect(results).To(HaveLen(20))
+			Expect(errs).To(HaveLen(1))
+			Expect(errs["upstream-error"]).To(MatchError("Upstream error: an error occurred"))
+		})
+
+		Context("with a token refresher", func() {
+			var refresher *mockTokenRefresher
+
+			BeforeEach(func() {
+				authToken = "expired-token"
+				refresher = newMockTokenRefresher()
+				refresher.RefreshAuthTokenOutput.Token <- "good-token"
+				refresher.RefreshAuthTokenOutput.AuthError <- nil
+			})
+
+			JustBeforeEach(func() {
+				cnsmr.RefreshTokenFrom(refresher)
+			})
+
+			It("refreshes the token once for all workers", func() {
+				results, errs := cnsmr.ContainerEnvelopesMulti(appIDs, authToken, 4)
+
+				Expect(errs).To(BeEmpty())
+				Expect(results).To(HaveLen(20))
+				Expect(refresher.RefreshAuthTokenCalled).To(HaveLen(1))
+			})
+
+			Context("when a refresh fails", func() {
+				BeforeEach(func() {
+					refresher = newMockTokenRefresher()
+					refresher.RefreshAuthTokenOutput.Token <- ""
+					refresher.RefreshAuthTokenOutput.AuthError <- stderrors.New("UAA unavailable")
+					refresher.RefreshAuthTokenOutput.Token <- "good-token"
+					refresher.RefreshAuthTokenOutput.AuthError <- nil
+				})
+
+				It("refreshes again for later apps", func() {
+					results, errs := cnsmr.ContainerEnvelopesMulti(appIDs, authToken, 1)
+
+					Expect(errs).To(HaveLen(1))
+					Expect(errs["app-0"]).To(MatchError("UAA unavailable"))
+					Expect(results).To(HaveLen(19))
+					Expect(refresher.RefreshAuthTokenCalled).To(HaveLen(2))
+				})
+			})
+		})
+	})
 })
+
+type multiAppHandler struct {
+	validToken string
+
+	lock     sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (h *multiAppHandler) maxInFlight() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.max
+}
+
+func (h *multiAppHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != h.validToken {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	h.lock.Lock()
+	h.inFlight++
+	if h.inFlight > h.max {
+		h.max = h.inFlight
+	}
+	h.lock.Unlock()
+	defer func() {
+		h.lock.Lock()
+		h.inFlight--
+		h.lock.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	appID := strings.Split(r.URL.Path, "/")[2]
+	env := createContainerMetric(0, 1000)
+	env.ContainerMetric.ApplicationId = proto.String(appID)
+	if appID == "upstream-error" {
+		env = createMessage("an error occurred", 1000)
+	}
+
+	mp := multipart.NewWriter(rw)
+	defer mp.Close()
+	rw.Header().Set("Content-Type", `multipart/x-protobuf; boundary=`+mp.Boundary())
+	partWriter, err := mp.CreatePart(nil)
+	if err != nil {
+		return
+	}
+	partWriter.Write(marshalMessage(env))
+}
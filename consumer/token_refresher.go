@@ -1,11 +1,29 @@
 package consumer
 
+import "context"
+
 //go:generate hel --type TokenRefresher --output mock_token_refresher_test.go
 
 type TokenRefresher interface {
 	RefreshAuthToken() (token string, authError error)
 }
 
+// ContextTokenRefresher is a TokenRefresher which can be cancelled.  When
+// the consumer's TokenRefresher implements it, RefreshAuthTokenContext is
+// called instead of RefreshAuthToken, with a context which is cancelled when
+// the stream or request that needs the token is closed.
+type ContextTokenRefresher interface {
+	TokenRefresher
+	RefreshAuthTokenContext(ctx context.Context) (token string, authError error)
+}
+
+// TokenInvalidator may be implemented by a TokenRefresher which caches
+// tokens.  InvalidateAuthToken is called with a token that the
+// trafficcontroller has rejected, before a new token is requested.
+type TokenInvalidator interface {
+	InvalidateAuthToken(token string)
+}
+
 func (c *Consumer) RefreshTokenFrom(tr TokenRefresher) {
 	c.refresherMutex.Lock()
 	defer c.refresherMutex.Unlock()
@@ -14,9 +32,30 @@ func (c *Consumer) RefreshTokenFrom(tr TokenRefresher) {
 	c.tokenRefresher = tr
 }
 
-func (c *Consumer) getToken() (string, error) {
+func (c *Consumer) getToken(ctx context.Context) (string, error) {
+	c.refresherMutex.RLock()
+	defer c.refresherMutex.RUnlock()
+
+	ctx, span := c.tracer.Start(ctx, SpanTokenRefresh)
+	defer span.End()
+
+	token, err := refreshToken(ctx, c.tokenRefresher)
+	span.RecordError(err)
+	return token, err
+}
+
+func refreshToken(ctx context.Context, tr TokenRefresher) (string, error) {
+	if ctr, ok := tr.(ContextTokenRefresher); ok {
+		return ctr.RefreshAuthTokenContext(ctx)
+	}
+	return tr.RefreshAuthToken()
+}
+
+func (c *Consumer) invalidateToken(token string) {
 	c.refresherMutex.RLock()
 	defer c.refresherMutex.RUnlock()
 
-	return c.tokenRefresher.RefreshAuthToken()
+	if invalidator, ok := c.tokenRefresher.(TokenInvalidator); ok {
+		invalidator.InvalidateAuthToken(token)
+	}
 }
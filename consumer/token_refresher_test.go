@@ -1,6 +1,7 @@
 package consumer_test
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -194,6 +195,78 @@ var _ = Describe("RefreshTokenFrom", func() {
 	})
 })
 
+var _ = Describe("ContextTokenRefresher", func() {
+	var (
+		cnsmr     *consumer.Consumer
+		server    *httptest.Server
+		refresher *blockingTokenRefresher
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(NewWebsocketHandler(make(chan []byte), 100*time.Millisecond))
+		refresher = &blockingTokenRefresher{
+			called:    make(chan struct{}, 10),
+			cancelled: make(chan error, 10),
+		}
+
+		cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+		cnsmr.RefreshTokenFrom(refresher)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("cancels a stream's token refresh when the consumer is closed", func() {
+		cnsmr.Stream("some-fake-app-guid", "")
+		Eventually(refresher.called).Should(Receive())
+
+		Expect(cnsmr.Close()).To(Succeed())
+		Eventually(refresher.cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("cancels a sync request's token refresh when the consumer is closed", func() {
+		errs := make(chan error, 1)
+		go func() {
+			defer GinkgoRecover()
+			_, err := cnsmr.RecentLogs("some-fake-app-guid", "")
+			errs <- err
+		}()
+		Eventually(refresher.called).Should(Receive())
+
+		Expect(cnsmr.Close()).To(Succeed())
+		Eventually(refresher.cancelled).Should(Receive(Equal(context.Canceled)))
+		Eventually(errs).Should(Receive(HaveOccurred()))
+	})
+
+	It("cancels a poll's token refresh when its context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cnsmr.PollContainerMetricsWithContext(ctx, "some-fake-app-guid", "", time.Minute)
+		Eventually(refresher.called).Should(Receive())
+
+		cancel()
+		Eventually(refresher.cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+})
+
+// blockingTokenRefresher is a ContextTokenRefresher whose refreshes only
+// return once their context is done.
+type blockingTokenRefresher struct {
+	called    chan struct{}
+	cancelled chan error
+}
+
+func (r *blockingTokenRefresher) RefreshAuthToken() (string, error) {
+	panic("RefreshAuthToken called on a ContextTokenRefresher")
+}
+
+func (r *blockingTokenRefresher) RefreshAuthTokenContext(ctx context.Context) (string, error) {
+	r.called <- struct{}{}
+	<-ctx.Done()
+	r.cancelled <- ctx.Err()
+	return "", ctx.Err()
+}
+
 type errorRespondingHandler struct {
 	subHandler       http.Handler
 	responseStatuses chan int
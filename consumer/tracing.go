@@ -0,0 +1,178 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Span names used by Consumer.
+const (
+	SpanRecentLogs         = "noaa.RecentLogs"
+	SpanContainerEnvelopes = "noaa.ContainerEnvelopes"
+	SpanWebsocketDial      = "noaa.websocket.dial"
+	SpanTokenRefresh       = "noaa.token.refresh"
+	SpanReconnect          = "noaa.reconnect"
+)
+
+// Tracer starts spans around Consumer operations.  Its shape follows
+// OpenTelemetry's, so that it can be implemented with a thin adapter.
+type Tracer interface {
+	// Start starts a span called name, as a child of any span in ctx, and
+	// returns a context containing the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError records err on the span.  It is a no-op if err is nil.
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key/value pair describing a Span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attr returns an Attribute.
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SetTracer sets the consumer to trace its operations with tracer.  By
+// default, operations are not traced.
+func (c *Consumer) SetTracer(tracer Tracer) {
+	c.tracer = tracer
+}
+
+func (c *Consumer) reconnectSpan(ctx context.Context, cycle int) (context.Context, Span) {
+	return c.tracer.Start(ctx, SpanReconnect, Attr("cycle", cycle))
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// RecordingTracer is a Tracer which keeps spans in memory, for use in
+// tests.
+type RecordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordingSpan
+}
+
+// RecordedSpan is a copy of a span started by a RecordingTracer.
+type RecordedSpan struct {
+	// ID identifies the span within its RecordingTracer.  ParentID is the ID
+	// of the parent span, or zero if the span has no parent.
+	ID, ParentID int
+	Name         string
+	Attributes   map[string]interface{}
+	Errors       []error
+	Start, End   time.Time
+	Ended        bool
+}
+
+type recordingSpan struct {
+	tracer *RecordingTracer
+	span   RecordedSpan
+}
+
+type recordingSpanKey struct{}
+
+// NewRecordingTracer returns an empty RecordingTracer.
+func NewRecordingTracer() *RecordingTracer {
+	return &RecordingTracer{}
+}
+
+// Start implements Tracer.
+func (t *RecordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	span := &recordingSpan{
+		tracer: t,
+		span: RecordedSpan{
+			ID:         len(t.spans) + 1,
+			Name:       name,
+			Attributes: make(map[string]interface{}),
+			Start:      time.Now(),
+		},
+	}
+	if parent, ok := ctx.Value(recordingSpanKey{}).(*recordingSpan); ok && parent.tracer == t {
+		span.span.ParentID = parent.span.ID
+	}
+	for _, attr := range attrs {
+		span.span.Attributes[attr.Key] = attr.Value
+	}
+	t.spans = append(t.spans, span)
+
+	return context.WithValue(ctx, recordingSpanKey{}, span), span
+}
+
+// Spans returns copies of all spans started so far, in the order they were
+// started.
+func (t *RecordingTracer) Spans() []RecordedSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	spans := make([]RecordedSpan, 0, len(t.spans))
+	for _, s := range t.spans {
+		span := s.span
+		span.Attributes = make(map[string]interface{}, len(s.span.Attributes))
+		for k, v := range s.span.Attributes {
+			span.Attributes[k] = v
+		}
+		span.Errors = append([]error(nil), s.span.Errors...)
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// SpansNamed returns copies of the spans called name.
+func (t *RecordingTracer) SpansNamed(name string) []RecordedSpan {
+	var spans []RecordedSpan
+	for _, span := range t.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	for _, attr := range attrs {
+		s.span.Attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.span.Errors = append(s.span.Errors, err)
+}
+
+func (s *recordingSpan) End() {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	if s.span.Ended {
+		return
+	}
+	s.span.Ended = true
+	s.span.End = time.Now()
+}
@@ -0,0 +1,146 @@
+package consumer_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetTracer", func() {
+	var (
+		tracer *consumer.RecordingTracer
+		server *httptest.Server
+		cnsmr  *consumer.Consumer
+	)
+
+	BeforeEach(func() {
+		tracer = consumer.NewRecordingTracer()
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+		cnsmr.SetTracer(tracer)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("traces RecentLogs with token refreshes as children", func() {
+		refresher := &countingTokenRefresher{tokens: []string{"some-token"}}
+		cnsmr.RefreshTokenFrom(refresher)
+
+		_, err := cnsmr.RecentLogs("some-app-guid", "")
+		Expect(err).To(HaveOccurred())
+
+		spans := tracer.Spans()
+		Expect(spans).To(HaveLen(2))
+		Expect(spans[0].Name).To(Equal(consumer.SpanRecentLogs))
+		Expect(spans[0].Attributes).To(HaveKeyWithValue("app_guid", "some-app-guid"))
+		Expect(spans[0].Errors).To(ConsistOf(err))
+		Expect(spans[0].Ended).To(BeTrue())
+
+		Expect(spans[1].Name).To(Equal(consumer.SpanTokenRefresh))
+		Expect(spans[1].ParentID).To(Equal(spans[0].ID))
+		Expect(spans[1].Ended).To(BeTrue())
+	})
+
+	It("traces ContainerEnvelopes", func() {
+		cnsmr.ContainerEnvelopes("some-app-guid", "some-token")
+
+		spans := tracer.SpansNamed(consumer.SpanContainerEnvelopes)
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].Errors).To(HaveLen(1))
+		Expect(spans[0].End).ToNot(BeTemporally("<", spans[0].Start))
+	})
+
+	It("traces each app of ContainerEnvelopesMulti", func() {
+		cnsmr.ContainerEnvelopesMulti([]string{"app-1", "app-2"}, "some-token", 2)
+
+		spans := tracer.SpansNamed(consumer.SpanContainerEnvelopes)
+		Expect(spans).To(HaveLen(2))
+		for _, span := range spans {
+			Expect(span.Errors).To(HaveLen(1))
+			Expect(span.Ended).To(BeTrue())
+		}
+	})
+
+	It("records token refresh errors", func() {
+		cnsmr.RefreshTokenFrom(&countingTokenRefresher{err: errors.New("uaa is down")})
+
+		cnsmr.ContainerEnvelopes("some-app-guid", "")
+
+		spans := tracer.SpansNamed(consumer.SpanTokenRefresh)
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].Errors).To(ConsistOf(MatchError("uaa is down")))
+	})
+
+	It("traces websocket dials and each reconnect cycle", func() {
+		cnsmr.SetMinRetryDelay(10 * time.Millisecond)
+		cnsmr.SetMaxRetryCount(2)
+
+		_, streamErrors := cnsmr.Stream("some-app-guid", "some-token")
+		for range streamErrors {
+		}
+
+		dials := tracer.SpansNamed(consumer.SpanWebsocketDial)
+		Expect(dials).To(HaveLen(3))
+		for _, dial := range dials {
+			Expect(dial.Attributes).To(HaveKeyWithValue("path", "/apps/some-app-guid/stream"))
+			Expect(dial.Attributes).To(HaveKeyWithValue("status_code", http.StatusNotFound))
+			Expect(dial.Errors).To(HaveLen(1))
+			Expect(dial.Ended).To(BeTrue())
+		}
+
+		cycles := tracer.SpansNamed(consumer.SpanReconnect)
+		Expect(cycles).To(HaveLen(3))
+		for i, cycle := range cycles {
+			Expect(cycle.Attributes).To(HaveKeyWithValue("cycle", i))
+			Expect(cycle.Ended).To(BeTrue())
+			Expect(dials[i].ParentID).To(Equal(cycle.ID))
+		}
+		Expect(cycles[0].Attributes).To(HaveKeyWithValue("delay", 10*time.Millisecond))
+		Expect(cycles[2].Errors).To(ContainElement(consumer.ErrMaxRetriesReached))
+	})
+
+	It("traces a stream's token refreshes as children of the reconnect cycle", func() {
+		cnsmr.RefreshTokenFrom(&countingTokenRefresher{tokens: []string{"some-token"}})
+		cnsmr.SetMaxRetryCount(0)
+
+		_, streamErrors := cnsmr.Stream("some-app-guid", "")
+		for range streamErrors {
+		}
+
+		cycles := tracer.SpansNamed(consumer.SpanReconnect)
+		Expect(cycles).To(HaveLen(1))
+		refreshes := tracer.SpansNamed(consumer.SpanTokenRefresh)
+		Expect(refreshes).To(HaveLen(1))
+		Expect(refreshes[0].ParentID).To(Equal(cycles[0].ID))
+	})
+
+	It("does not trace by default", func() {
+		cnsmr = consumer.New("ws://"+server.Listener.Addr().String(), nil, nil)
+		_, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+		Expect(err).To(HaveOccurred())
+		Expect(tracer.Spans()).To(BeEmpty())
+	})
+
+	Describe("RecordingTracer", func() {
+		It("only links spans from the same tracer", func() {
+			other := consumer.NewRecordingTracer()
+			ctx, _ := tracer.Start(context.Background(), "parent")
+			other.Start(ctx, "child")
+			tracer.Start(ctx, "sibling")
+
+			Expect(other.Spans()[0].ParentID).To(BeZero())
+			Expect(tracer.Spans()[1].ParentID).To(Equal(tracer.Spans()[0].ID))
+		})
+	})
+})
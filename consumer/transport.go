@@ -0,0 +1,84 @@
+package consumer
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer/internal"
+)
+
+const (
+	// DefaultMaxIdleConnsPerHost is the default number of idle connections
+	// kept open to each trafficcontroller for reuse by sync requests.
+	DefaultMaxIdleConnsPerHost = 10
+	// DefaultIdleConnTimeout is the default time after which an idle
+	// connection is closed.
+	DefaultIdleConnTimeout = 90 * time.Second
+
+	// maxDrainBytes is the most that is read from a response body before it
+	// is closed, so that its connection can be reused.
+	maxDrainBytes = 64 << 10
+)
+
+// SetHTTPClient sets the client used for sync requests (e.g. RecentLogs and
+// ContainerEnvelopes), for instance to add instrumentation.  The client is
+// copied, so later changes to it have no effect.  The tlsConfig and proxy
+// passed to New are not applied to the client's transport.
+//
+// Websocket streams are not affected.
+func (c *Consumer) SetHTTPClient(client *http.Client) {
+	clientCopy := *client
+	c.client = &clientCopy
+}
+
+// SetTransport sets the transport used for sync requests, keeping the
+// client's timeout.  The tlsConfig and proxy passed to New are not applied
+// to transport.
+func (c *Consumer) SetTransport(transport http.RoundTripper) {
+	c.client.Transport = transport
+}
+
+// SetHTTPTimeout sets the time limit for each sync request, including
+// reading the response.  Defaults to 10 seconds.
+func (c *Consumer) SetHTTPTimeout(timeout time.Duration) {
+	c.client.Timeout = timeout
+}
+
+// SetIdleConnLimits sets the number of idle connections kept open to each
+// trafficcontroller by sync requests, and how long they are kept.  A
+// maxIdleConnsPerHost of less than zero disables connection reuse.  It has
+// no effect on a transport set with SetTransport or SetHTTPClient.
+//
+// Defaults to DefaultMaxIdleConnsPerHost and DefaultIdleConnTimeout.
+func (c *Consumer) SetIdleConnLimits(maxIdleConnsPerHost int, idleConnTimeout time.Duration) {
+	transport, ok := c.client.Transport.(*http.Transport)
+	if !ok || transport != c.transport {
+		return
+	}
+	transport.DisableKeepAlives = maxIdleConnsPerHost < 0
+	if maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = idleConnTimeout
+}
+
+func newTransport(tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	return &http.Transport{
+		Proxy:               proxy,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: internal.Timeout,
+		MaxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     DefaultIdleConnTimeout,
+	}
+}
+
+// drainAndClose reads what remains of body, up to a limit, before closing
+// it, so that the connection it was read from can be reused.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainBytes))
+	body.Close()
+}
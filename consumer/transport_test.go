@@ -0,0 +1,162 @@
+package consumer_test
+
+import (
+	"crypto/tls"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sync request transport", func() {
+	var (
+		server      *httptest.Server
+		connections *int64
+		tlsConfig   *tls.Config
+		cnsmr       *consumer.Consumer
+	)
+
+	BeforeEach(func() {
+		server, connections = newRecentLogsServer()
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+		cnsmr = consumer.New("wss://"+server.Listener.Addr().String(), tlsConfig, nil)
+	})
+
+	AfterEach(func() {
+		cnsmr.Close()
+		server.Close()
+	})
+
+	It("reuses connections between requests", func() {
+		for i := 0; i < 3; i++ {
+			logs, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(1))
+		}
+		Expect(atomic.LoadInt64(connections)).To(BeEquivalentTo(1))
+	})
+
+	It("reuses connections after error responses", func() {
+		for i := 0; i < 3; i++ {
+			_, err := cnsmr.RecentLogs("some-app-guid", "bad-token")
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(atomic.LoadInt64(connections)).To(BeEquivalentTo(1))
+	})
+
+	It("opens a connection for each request when connection reuse is disabled", func() {
+		cnsmr.SetIdleConnLimits(-1, consumer.DefaultIdleConnTimeout)
+
+		for i := 0; i < 3; i++ {
+			_, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(atomic.LoadInt64(connections)).To(BeEquivalentTo(3))
+	})
+
+	It("uses the transport set with SetTransport", func() {
+		transport := &countingRoundTripper{next: &http.Transport{TLSClientConfig: tlsConfig}}
+		cnsmr.SetTransport(transport)
+
+		_, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt64(&transport.requests)).To(BeEquivalentTo(1))
+	})
+
+	It("uses a copy of the client set with SetHTTPClient", func() {
+		transport := &countingRoundTripper{next: &http.Transport{TLSClientConfig: tlsConfig}}
+		client := &http.Client{Transport: transport}
+		cnsmr.SetHTTPClient(client)
+		cnsmr.SetHTTPTimeout(time.Second)
+
+		_, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt64(&transport.requests)).To(BeEquivalentTo(1))
+		Expect(client.Timeout).To(BeZero())
+	})
+
+	It("applies the timeout set with SetHTTPTimeout", func() {
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		})
+		cnsmr.SetHTTPTimeout(50 * time.Millisecond)
+
+		_, err := cnsmr.RecentLogs("some-app-guid", "some-token")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+type countingRoundTripper struct {
+	requests int64
+	next     http.RoundTripper
+}
+
+func (t *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.requests, 1)
+	return t.next.RoundTrip(req)
+}
+
+// newRecentLogsServer returns a TLS server which responds to requests
+// authorized with "some-token" with a single log message, and the count of
+// connections made to it.
+func newRecentLogsServer() (*httptest.Server, *int64) {
+	message := marshalMessage(createMessage("a log message", 1000))
+	connections := new(int64)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "some-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("not authorized"))
+			return
+		}
+		mp := multipart.NewWriter(w)
+		defer mp.Close()
+		w.Header().Set("Content-Type", `multipart/x-protobuf; boundary=`+mp.Boundary())
+		part, err := mp.CreatePart(nil)
+		if err != nil {
+			return
+		}
+		part.Write(message)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(connections, 1)
+		}
+	}
+	server.StartTLS()
+	return server, connections
+}
+
+func BenchmarkRecentLogsKeepAlive(b *testing.B) {
+	benchmarkRecentLogs(b, consumer.DefaultMaxIdleConnsPerHost)
+}
+
+func BenchmarkRecentLogsNoKeepAlive(b *testing.B) {
+	benchmarkRecentLogs(b, -1)
+}
+
+func benchmarkRecentLogs(b *testing.B, maxIdleConnsPerHost int) {
+	server, connections := newRecentLogsServer()
+	defer server.Close()
+
+	cnsmr := consumer.New("wss://"+server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true}, nil)
+	defer cnsmr.Close()
+	cnsmr.SetIdleConnLimits(maxIdleConnsPerHost, consumer.DefaultIdleConnTimeout)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cnsmr.RecentLogs("some-app-guid", "some-token"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(connections))/float64(b.N), "handshakes/op")
+}
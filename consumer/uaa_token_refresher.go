@@ -0,0 +1,153 @@
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+)
+
+const DefaultUAATimeout = 10 * time.Second
+
+// UAATokenRefresher is a TokenRefresher which fetches tokens from a UAA
+// token endpoint, using either the OAuth2 client credentials grant or the
+// refresh token grant.
+//
+// It fetches a new token on every call; wrap it in a CachingTokenRefresher
+// to share tokens between connections.
+type UAATokenRefresher struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	lock         sync.Mutex
+	refreshToken string
+}
+
+type UAATokenRefresherOption func(*uaaConfig)
+
+type uaaConfig struct {
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// WithUAATLSConfig sets the TLS configuration used to connect to UAA.
+func WithUAATLSConfig(tlsConfig *tls.Config) UAATokenRefresherOption {
+	return func(c *uaaConfig) {
+		c.tlsConfig = tlsConfig
+	}
+}
+
+// WithUAATimeout sets the timeout for each token request.  Defaults to
+// DefaultUAATimeout.
+func WithUAATimeout(timeout time.Duration) UAATokenRefresherOption {
+	return func(c *uaaConfig) {
+		c.timeout = timeout
+	}
+}
+
+// NewClientCredentialsRefresher returns a UAATokenRefresher which requests
+// tokens from the UAA at uaaURL using the client credentials grant.
+func NewClientCredentialsRefresher(uaaURL, clientID, clientSecret string, opts ...UAATokenRefresherOption) *UAATokenRefresher {
+	return newUAATokenRefresher(uaaURL, clientID, clientSecret, "", opts)
+}
+
+// NewRefreshTokenRefresher returns a UAATokenRefresher which requests tokens
+// from the UAA at uaaURL using the refresh token grant.  If UAA issues a new
+// refresh token along with an access token, it is used for the next request.
+func NewRefreshTokenRefresher(uaaURL, clientID, clientSecret, refreshToken string, opts ...UAATokenRefresherOption) *UAATokenRefresher {
+	return newUAATokenRefresher(uaaURL, clientID, clientSecret, refreshToken, opts)
+}
+
+func newUAATokenRefresher(uaaURL, clientID, clientSecret, refreshToken string, opts []UAATokenRefresherOption) *UAATokenRefresher {
+	config := &uaaConfig{timeout: DefaultUAATimeout}
+	for _, o := range opts {
+		o(config)
+	}
+
+	return &UAATokenRefresher{
+		tokenURL:     strings.TrimRight(uaaURL, "/") + "/oauth/token",
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		refreshToken: refreshToken,
+		client: &http.Client{
+			Timeout: config.timeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: config.tlsConfig,
+			},
+		},
+	}
+}
+
+// RefreshAuthToken implements TokenRefresher.  The returned token includes
+// its token type, e.g. "bearer <access token>".
+func (r *UAATokenRefresher) RefreshAuthToken() (string, error) {
+	return r.RefreshAuthTokenContext(context.Background())
+}
+
+// RefreshAuthTokenContext implements ContextTokenRefresher.  The token
+// request is cancelled when ctx is done.
+func (r *UAATokenRefresher) RefreshAuthTokenContext(ctx context.Context) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	form := url.Values{"response_type": {"token"}}
+	if r.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", r.refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+
+	req, err := http.NewRequest("POST", r.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(r.clientID), url.QueryEscape(r.clientSecret))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", noaa_errors.NewKindError(noaa_errors.ErrDial, fmt.Errorf("UAA token request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		httpErr := noaa_errors.NewHTTPError(resp, fmt.Errorf("UAA token request failed"))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest {
+			return "", noaa_errors.NewKindError(noaa_errors.ErrAuth, httpErr)
+		}
+		return "", httpErr
+	}
+
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", noaa_errors.NewKindError(noaa_errors.ErrProtocol, fmt.Errorf("invalid UAA token response: %w", err))
+	}
+	if token.AccessToken == "" {
+		return "", noaa_errors.NewKindError(noaa_errors.ErrProtocol, fmt.Errorf("invalid UAA token response: no access_token"))
+	}
+
+	if token.RefreshToken != "" && r.refreshToken != "" {
+		r.refreshToken = token.RefreshToken
+	}
+	if token.TokenType == "" {
+		token.TokenType = "bearer"
+	}
+	return token.TokenType + " " + token.AccessToken, nil
+}
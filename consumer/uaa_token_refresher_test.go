@@ -0,0 +1,178 @@
+package consumer_test
+
+import (
+	"context"
+	"crypto/tls"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UAATokenRefresher", func() {
+	var (
+		uaa      *fakeUAA
+		server   *httptest.Server
+		requests chan url.Values
+	)
+
+	BeforeEach(func() {
+		requests = make(chan url.Values, 10)
+		uaa = &fakeUAA{
+			requests:     requests,
+			clientID:     "some-client",
+			clientSecret: "some-secret",
+			status:       http.StatusOK,
+		}
+		server = httptest.NewServer(uaa)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("NewClientCredentialsRefresher", func() {
+		It("requests a token with the client credentials grant", func() {
+			refresher := consumer.NewClientCredentialsRefresher(server.URL, "some-client", "some-secret")
+
+			token, err := refresher.RefreshAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token).To(Equal("bearer access-token-1"))
+
+			var form url.Values
+			Eventually(requests).Should(Receive(&form))
+			Expect(form.Get("grant_type")).To(Equal("client_credentials"))
+		})
+
+		It("returns an auth error when the credentials are rejected", func() {
+			refresher := consumer.NewClientCredentialsRefresher(server.URL, "some-client", "wrong-secret")
+
+			_, err := refresher.RefreshAuthToken()
+			Expect(err).To(HaveKind(noaa_errors.ErrAuth))
+
+			var httpErr *noaa_errors.HTTPError
+			Expect(stderrors.As(err, &httpErr)).To(BeTrue())
+			Expect(httpErr.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(string(httpErr.Body)).To(ContainSubstring("Bad credentials"))
+		})
+
+		It("returns a server status error when UAA fails", func() {
+			uaa.status = http.StatusInternalServerError
+			refresher := consumer.NewClientCredentialsRefresher(server.URL, "some-client", "some-secret")
+
+			_, err := refresher.RefreshAuthToken()
+			Expect(err).To(HaveKind(noaa_errors.ErrServerStatus))
+		})
+
+		It("returns a protocol error for an invalid response", func() {
+			uaa.body = "not json"
+			refresher := consumer.NewClientCredentialsRefresher(server.URL, "some-client", "some-secret")
+
+			_, err := refresher.RefreshAuthToken()
+			Expect(err).To(HaveKind(noaa_errors.ErrProtocol))
+		})
+
+		It("times out slow requests", func() {
+			uaa.delay = 200 * time.Millisecond
+			refresher := consumer.NewClientCredentialsRefresher(server.URL, "some-client", "some-secret",
+				consumer.WithUAATimeout(50*time.Millisecond),
+			)
+
+			_, err := refresher.RefreshAuthToken()
+			Expect(err).To(HaveKind(noaa_errors.ErrDial))
+		})
+
+		It("cancels the token request when its context is done", func() {
+			uaa.delay = 200 * time.Millisecond
+			refresher := consumer.NewClientCredentialsRefresher(server.URL, "some-client", "some-secret")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := refresher.RefreshAuthTokenContext(ctx)
+			Expect(stderrors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+
+		It("connects to UAA over TLS with the given config", func() {
+			tlsServer := httptest.NewTLSServer(uaa)
+			defer tlsServer.Close()
+
+			refresher := consumer.NewClientCredentialsRefresher(tlsServer.URL, "some-client", "some-secret")
+			_, err := refresher.RefreshAuthToken()
+			Expect(err).To(HaveOccurred())
+
+			refresher = consumer.NewClientCredentialsRefresher(tlsServer.URL, "some-client", "some-secret",
+				consumer.WithUAATLSConfig(&tls.Config{InsecureSkipVerify: true}),
+			)
+			token, err := refresher.RefreshAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token).To(HavePrefix("bearer "))
+		})
+	})
+
+	Describe("NewRefreshTokenRefresher", func() {
+		It("requests tokens with the latest refresh token", func() {
+			refresher := consumer.NewRefreshTokenRefresher(server.URL, "some-client", "some-secret", "refresh-token-0")
+
+			token, err := refresher.RefreshAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token).To(Equal("bearer access-token-1"))
+
+			var form url.Values
+			Eventually(requests).Should(Receive(&form))
+			Expect(form.Get("grant_type")).To(Equal("refresh_token"))
+			Expect(form.Get("refresh_token")).To(Equal("refresh-token-0"))
+
+			_, err = refresher.RefreshAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(requests).Should(Receive(&form))
+			Expect(form.Get("refresh_token")).To(Equal("refresh-token-1"))
+		})
+	})
+})
+
+type fakeUAA struct {
+	requests     chan url.Values
+	clientID     string
+	clientSecret string
+	status       int
+	body         string
+	delay        time.Duration
+	issued       int
+}
+
+func (u *fakeUAA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(u.delay)
+
+	if r.Method != "POST" || r.URL.Path != "/oauth/token" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != u.clientID || secret != u.clientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"unauthorized","error_description":"Bad credentials"}`)
+		return
+	}
+	r.ParseForm()
+	u.requests <- r.PostForm
+
+	w.WriteHeader(u.status)
+	if u.body != "" {
+		fmt.Fprint(w, u.body)
+		return
+	}
+	u.issued++
+	refreshToken := ""
+	if r.PostForm.Get("grant_type") == "refresh_token" {
+		refreshToken = fmt.Sprintf("refresh-token-%d", u.issued)
+	}
+	fmt.Fprintf(w, `{"access_token":"access-token-%d","token_type":"bearer","refresh_token":%q}`, u.issued, refreshToken)
+}
@@ -0,0 +1,113 @@
+package noaa
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// AppContainerSummary aggregates a snapshot of container metrics for a
+// single app, such as the envelopes returned by consumer.ContainerEnvelopes.
+type AppContainerSummary struct {
+	// Instances is the number of distinct instance indexes in the snapshot.
+	Instances int
+
+	TotalCPUPercentage float64
+	AvgCPUPercentage   float64
+	MaxCPUPercentage   float64
+
+	Memory UsageSummary
+	Disk   UsageSummary
+
+	// StaleInstances holds the instance indexes, in ascending order, whose
+	// most recent metric is older than the staleness threshold.
+	StaleInstances []int32
+}
+
+// UsageSummary aggregates a resource (memory or disk) across instances.
+type UsageSummary struct {
+	TotalBytes uint64
+	AvgBytes   uint64
+	MaxBytes   uint64
+
+	// TotalQuotaBytes is the sum of the per-instance quotas.
+	TotalQuotaBytes uint64
+
+	// MaxUtilization is the highest per-instance ratio of usage to quota.
+	// Instances without a quota are not considered.
+	MaxUtilization float64
+}
+
+// Utilization returns the ratio of total usage to total quota, or 0 if no
+// instance reported a quota.
+func (u UsageSummary) Utilization() float64 {
+	if u.TotalQuotaBytes == 0 {
+		return 0
+	}
+	return float64(u.TotalBytes) / float64(u.TotalQuotaBytes)
+}
+
+// NewAppContainerSummary builds an AppContainerSummary from envelopes.
+// Envelopes which are not container metrics are ignored, and if there are
+// several envelopes for an instance index only the most recent is used.
+//
+// An instance is stale if its most recent envelope is more than staleAfter
+// older than now.  A staleAfter of zero or less disables stale detection.
+func NewAppContainerSummary(envelopes []*events.Envelope, now time.Time, staleAfter time.Duration) *AppContainerSummary {
+	latest := make(map[int32]*events.Envelope)
+	for _, env := range envelopes {
+		if env.GetEventType() != events.Envelope_ContainerMetric {
+			continue
+		}
+		index := env.GetContainerMetric().GetInstanceIndex()
+		if prev, ok := latest[index]; ok && prev.GetTimestamp() >= env.GetTimestamp() {
+			continue
+		}
+		latest[index] = env
+	}
+
+	summary := &AppContainerSummary{Instances: len(latest)}
+	if summary.Instances == 0 {
+		return summary
+	}
+
+	metrics := make([]*events.ContainerMetric, 0, len(latest))
+	for _, env := range latest {
+		metrics = append(metrics, env.GetContainerMetric())
+	}
+	SortContainerMetrics(metrics)
+
+	for _, m := range metrics {
+		cpu := m.GetCpuPercentage()
+		summary.TotalCPUPercentage += cpu
+		if cpu > summary.MaxCPUPercentage {
+			summary.MaxCPUPercentage = cpu
+		}
+		summary.Memory.add(m.GetMemoryBytes(), m.GetMemoryBytesQuota())
+		summary.Disk.add(m.GetDiskBytes(), m.GetDiskBytesQuota())
+
+		env := latest[m.GetInstanceIndex()]
+		if staleAfter > 0 && now.Sub(time.Unix(0, env.GetTimestamp())) > staleAfter {
+			summary.StaleInstances = append(summary.StaleInstances, m.GetInstanceIndex())
+		}
+	}
+
+	summary.AvgCPUPercentage = summary.TotalCPUPercentage / float64(summary.Instances)
+	summary.Memory.AvgBytes = summary.Memory.TotalBytes / uint64(summary.Instances)
+	summary.Disk.AvgBytes = summary.Disk.TotalBytes / uint64(summary.Instances)
+	return summary
+}
+
+func (u *UsageSummary) add(bytes, quota uint64) {
+	u.TotalBytes += bytes
+	u.TotalQuotaBytes += quota
+	if bytes > u.MaxBytes {
+		u.MaxBytes = bytes
+	}
+	if quota == 0 {
+		return
+	}
+	if utilization := float64(bytes) / float64(quota); utilization > u.MaxUtilization {
+		u.MaxUtilization = utilization
+	}
+}
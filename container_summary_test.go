@@ -0,0 +1,108 @@
+package noaa_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/noaa"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AppContainerSummary", func() {
+	var (
+		now       time.Time
+		envelopes []*events.Envelope
+	)
+
+	BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		envelopes = []*events.Envelope{
+			createContainerEnvelope(0, now.Add(-time.Second), 10, 100, 1000, 200, 2000),
+			createContainerEnvelope(1, now.Add(-2*time.Second), 30, 300, 1000, 600, 2000),
+		}
+	})
+
+	It("aggregates cpu, memory and disk across instances", func() {
+		summary := noaa.NewAppContainerSummary(envelopes, now, time.Minute)
+
+		Expect(summary.Instances).To(Equal(2))
+		Expect(summary.TotalCPUPercentage).To(Equal(40.0))
+		Expect(summary.AvgCPUPercentage).To(Equal(20.0))
+		Expect(summary.MaxCPUPercentage).To(Equal(30.0))
+
+		Expect(summary.Memory.TotalBytes).To(Equal(uint64(400)))
+		Expect(summary.Memory.AvgBytes).To(Equal(uint64(200)))
+		Expect(summary.Memory.MaxBytes).To(Equal(uint64(300)))
+		Expect(summary.Memory.TotalQuotaBytes).To(Equal(uint64(2000)))
+		Expect(summary.Memory.Utilization()).To(Equal(0.2))
+		Expect(summary.Memory.MaxUtilization).To(Equal(0.3))
+
+		Expect(summary.Disk.TotalBytes).To(Equal(uint64(800)))
+		Expect(summary.Disk.MaxUtilization).To(Equal(0.3))
+		Expect(summary.StaleInstances).To(BeEmpty())
+	})
+
+	It("uses only the most recent envelope for each instance", func() {
+		envelopes = append(envelopes, createContainerEnvelope(1, now.Add(-time.Minute), 90, 900, 1000, 900, 2000))
+
+		summary := noaa.NewAppContainerSummary(envelopes, now, 0)
+
+		Expect(summary.Instances).To(Equal(2))
+		Expect(summary.MaxCPUPercentage).To(Equal(30.0))
+	})
+
+	It("ignores envelopes which are not container metrics", func() {
+		envelopes = append(envelopes, &events.Envelope{
+			EventType: events.Envelope_LogMessage.Enum(),
+			Timestamp: proto.Int64(now.UnixNano()),
+		})
+
+		summary := noaa.NewAppContainerSummary(envelopes, now, 0)
+
+		Expect(summary.Instances).To(Equal(2))
+	})
+
+	It("detects stale instances", func() {
+		envelopes = append(envelopes, createContainerEnvelope(2, now.Add(-5*time.Minute), 0, 0, 0, 0, 0))
+
+		summary := noaa.NewAppContainerSummary(envelopes, now, time.Minute)
+
+		Expect(summary.StaleInstances).To(Equal([]int32{2}))
+	})
+
+	It("does not report utilization without a quota", func() {
+		summary := noaa.NewAppContainerSummary([]*events.Envelope{
+			createContainerEnvelope(0, now, 0, 100, 0, 100, 0),
+		}, now, 0)
+
+		Expect(summary.Memory.Utilization()).To(Equal(0.0))
+		Expect(summary.Memory.MaxUtilization).To(Equal(0.0))
+	})
+
+	It("returns an empty summary for an empty snapshot", func() {
+		summary := noaa.NewAppContainerSummary(nil, now, time.Minute)
+
+		Expect(summary.Instances).To(Equal(0))
+		Expect(summary.AvgCPUPercentage).To(Equal(0.0))
+	})
+})
+
+func createContainerEnvelope(index int32, timestamp time.Time, cpu float64, mem, memQuota, disk, diskQuota uint64) *events.Envelope {
+	return &events.Envelope{
+		EventType: events.Envelope_ContainerMetric.Enum(),
+		Origin:    proto.String("fake-origin"),
+		Timestamp: proto.Int64(timestamp.UnixNano()),
+		ContainerMetric: &events.ContainerMetric{
+			ApplicationId:    proto.String("appId"),
+			InstanceIndex:    proto.Int32(index),
+			CpuPercentage:    proto.Float64(cpu),
+			MemoryBytes:      proto.Uint64(mem),
+			MemoryBytesQuota: proto.Uint64(memQuota),
+			DiskBytes:        proto.Uint64(disk),
+			DiskBytesQuota:   proto.Uint64(diskQuota),
+		},
+	}
+}
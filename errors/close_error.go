@@ -0,0 +1,28 @@
+package errors
+
+import "fmt"
+
+// CloseError is a type that noaa uses when trafficcontroller closes a
+// websocket stream.  Code is the websocket close code (e.g. 1001 when the
+// server is going away, 1008 when a slow consumer is disconnected) and Reason
+// is the text sent by the server.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+// NewCloseError constructs a CloseError.
+func NewCloseError(code int, reason string) *CloseError {
+	return &CloseError{
+		Code:   code,
+		Reason: reason,
+	}
+}
+
+// Error implements error.
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: close %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: close %d: %s", e.Code, e.Reason)
+}
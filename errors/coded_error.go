@@ -0,0 +1,57 @@
+package errors
+
+import "errors"
+
+// CodedError is a type that noaa uses to attach one of the codes in
+// error_codes.go (e.g. ERR_DIAL) to an error, so that callers can switch on
+// a stable code rather than the message.
+type CodedError struct {
+	Code int32
+	Err  error
+}
+
+// NewCodedError constructs a CodedError with the given code from any error.
+func NewCodedError(code int32, err error) *CodedError {
+	return &CodedError{
+		Code: code,
+		Err:  err,
+	}
+}
+
+// Code returns the code of the first CodedError in err's chain.  The boolean
+// is false if there is none.
+func Code(err error) (int32, bool) {
+	var codedErr *CodedError
+	if !errors.As(err, &codedErr) {
+		return 0, false
+	}
+	return codedErr.Code, true
+}
+
+// Error implements error.
+func (e *CodedError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *CodedError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is a CodedError with the same code, or is the
+// kind (e.g. ErrDial) corresponding to e's code.
+func (e *CodedError) Is(target error) bool {
+	if t, ok := target.(*CodedError); ok {
+		return t.Code == e.Code
+	}
+
+	switch e.Code {
+	case ERR_LOST_CONNECTION:
+		return target == ErrProtocol
+	case ERR_DIAL:
+		return target == ErrDial
+	case ERR_IDLE_TIMEOUT:
+		return target == ErrTimeout
+	}
+	return false
+}
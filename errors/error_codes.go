@@ -2,3 +2,5 @@ package errors
 
 const ERR_LOST_CONNECTION = int32(1)
 const ERR_DIAL = int32(2)
+const ERR_IDLE_TIMEOUT = int32(3)
+const ERR_MAX_RETRIES = int32(4)
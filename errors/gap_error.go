@@ -0,0 +1,40 @@
+package errors
+
+import (
+	"fmt"
+	"time"
+)
+
+// GapError is a type that noaa uses when a reconnecting stream has been
+// re-established after a disconnect.  Envelopes with timestamps between Start
+// and End may not have been received.  It is informational; the stream is
+// still open when it is received.
+type GapError struct {
+	// Start is the timestamp of the last envelope received before the
+	// disconnect.
+	Start time.Time
+	// End is the timestamp of the first envelope received after reconnecting.
+	End time.Time
+	// Attempts is the number of connection attempts it took to reconnect.
+	Attempts int
+}
+
+// NewGapError constructs a GapError covering the window from start to end.
+func NewGapError(start, end time.Time, attempts int) GapError {
+	return GapError{
+		Start:    start,
+		End:      end,
+		Attempts: attempts,
+	}
+}
+
+// Duration returns the length of the window that may be missing envelopes.
+func (e GapError) Duration() time.Duration {
+	return e.End.Sub(e.Start)
+}
+
+// Error implements error.
+func (e GapError) Error() string {
+	return fmt.Sprintf("stream gap of %s from %s to %s after %d reconnect attempt(s)",
+		e.Duration(), e.Start.Format(time.RFC3339Nano), e.End.Format(time.RFC3339Nano), e.Attempts)
+}
@@ -0,0 +1,86 @@
+package errors
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxHTTPErrorBodySize is the maximum number of bytes of a response body
+// kept in an HTTPError.
+const MaxHTTPErrorBodySize = 1024
+
+// HTTPError is a type that noaa uses when trafficcontroller responds with an
+// unexpected HTTP status code.  It is of kind ErrServerStatus.
+type HTTPError struct {
+	StatusCode int
+	Header     http.Header
+	// Body holds up to MaxHTTPErrorBodySize bytes of the response body.
+	Body []byte
+	Err  error
+}
+
+// NewHTTPError constructs an HTTPError from resp, reading up to
+// MaxHTTPErrorBodySize bytes of its body.  err describes the failure and may
+// be nil.
+func NewHTTPError(resp *http.Response, err error) *HTTPError {
+	httpErr := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Err:        err,
+	}
+	if resp.Body != nil {
+		httpErr.Body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPErrorBodySize))
+	}
+	return httpErr
+}
+
+// RetryAfter returns the delay requested by the Retry-After header of a 429
+// (Too Many Requests) or 503 (Service Unavailable) response.  The boolean is
+// false for other status codes, or when the header is missing or invalid.
+func (e *HTTPError) RetryAfter() (time.Duration, bool) {
+	if e.StatusCode != http.StatusTooManyRequests && e.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(e.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// Error implements error.
+func (e *HTTPError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("unexpected HTTP status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%s (HTTP status %d)", e.Err.Error(), e.StatusCode)
+}
+
+// Unwrap returns the underlying error.
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrServerStatus.
+func (e *HTTPError) Is(target error) bool {
+	return target == ErrServerStatus
+}
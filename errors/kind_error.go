@@ -0,0 +1,43 @@
+package errors
+
+import "errors"
+
+// Kinds of failure that errors returned by noaa can be compared against with
+// errors.Is.
+var (
+	ErrAuth         = errors.New("authorization failed")
+	ErrDial         = errors.New("failed to connect to trafficcontroller")
+	ErrProtocol     = errors.New("unexpected response from trafficcontroller")
+	ErrServerStatus = errors.New("unexpected status code from trafficcontroller")
+	ErrTimeout      = errors.New("timed out")
+)
+
+// KindError is a type that noaa uses to attach one of the kinds above (e.g.
+// ErrDial) to an error, without changing its message.
+type KindError struct {
+	Kind error
+	Err  error
+}
+
+// NewKindError constructs a KindError of the given kind from any error.
+func NewKindError(kind, err error) *KindError {
+	return &KindError{
+		Kind: kind,
+		Err:  err,
+	}
+}
+
+// Error implements error.
+func (e *KindError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *KindError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of e.
+func (e *KindError) Is(target error) bool {
+	return target == e.Kind
+}
@@ -0,0 +1,34 @@
+package errors
+
+import "fmt"
+
+// MessageTooLargeError is a type that noaa uses when a websocket frame or a
+// part of a sync response is larger than the configured limit.  If Skipped
+// is true, the message was discarded and the stream or request carried on;
+// otherwise the stream's connection or the request was abandoned.
+type MessageTooLargeError struct {
+	Limit   int64
+	Skipped bool
+}
+
+// NewMessageTooLargeError constructs a MessageTooLargeError.
+func NewMessageTooLargeError(limit int64, skipped bool) *MessageTooLargeError {
+	return &MessageTooLargeError{
+		Limit:   limit,
+		Skipped: skipped,
+	}
+}
+
+// Error implements error.
+func (e *MessageTooLargeError) Error() string {
+	message := fmt.Sprintf("message larger than the limit of %d bytes", e.Limit)
+	if e.Skipped {
+		message += "; skipped"
+	}
+	return message
+}
+
+// Is reports whether target is ErrProtocol.
+func (e *MessageTooLargeError) Is(target error) bool {
+	return target == ErrProtocol
+}
@@ -20,3 +20,8 @@ func NewNonRetryError(err error) NonRetryError {
 func (e NonRetryError) Error() string {
 	return fmt.Sprintf("Please ask your Cloud Foundry Operator to check the platform configuration: %s", e.Err.Error())
 }
+
+// Unwrap returns the underlying error.
+func (e NonRetryError) Unwrap() error {
+	return e.Err
+}
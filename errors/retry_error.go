@@ -18,3 +18,8 @@ func NewRetryError(err error) RetryError {
 func (e RetryError) Error() string {
 	return e.Err.Error()
 }
+
+// Unwrap returns the underlying error.
+func (e RetryError) Unwrap() error {
+	return e.Err
+}
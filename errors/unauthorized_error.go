@@ -1,13 +1,21 @@
 package errors
 
+// UnauthorizedError is a type that noaa uses when trafficcontroller rejects
+// the auth token.  It is of kind ErrAuth.
 type UnauthorizedError struct {
-	description string
+	// Description is the body of trafficcontroller's response.
+	Description string
 }
 
 func NewUnauthorizedError(description string) error {
-	return &UnauthorizedError{description: description}
+	return &UnauthorizedError{Description: description}
 }
 
 func (err *UnauthorizedError) Error() string {
-	return "Unauthorized error: " + err.description
+	return "Unauthorized error: " + err.Description
+}
+
+// Is reports whether target is ErrAuth.
+func (err *UnauthorizedError) Is(target error) bool {
+	return target == ErrAuth
 }
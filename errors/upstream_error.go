@@ -0,0 +1,53 @@
+package errors
+
+import (
+	"strings"
+	"time"
+)
+
+// permanentUpstreamMessages are substrings of upstream error messages which
+// indicate that retrying the request will not help.
+var permanentUpstreamMessages = []string{
+	"not found",
+	"does not exist",
+	"unauthorized",
+	"not authorized",
+	"forbidden",
+	"invalid",
+}
+
+// UpstreamError is a type that noaa uses when trafficcontroller responds
+// successfully, but with an error from further upstream (reported as a log
+// message) in place of the requested data.
+type UpstreamError struct {
+	Message    string
+	SourceType string
+	Timestamp  time.Time
+}
+
+// NewUpstreamError constructs an UpstreamError.
+func NewUpstreamError(message, sourceType string, timestamp time.Time) *UpstreamError {
+	return &UpstreamError{
+		Message:    message,
+		SourceType: sourceType,
+		Timestamp:  timestamp,
+	}
+}
+
+// Retryable reports whether the same request may succeed later.  Errors such
+// as an unknown app or a lack of permissions are not retryable; anything else
+// is assumed to be a transient backend failure.
+func (e *UpstreamError) Retryable() bool {
+	message := strings.ToLower(e.Message)
+	for _, permanent := range permanentUpstreamMessages {
+		if strings.Contains(message, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// Error implements error.
+func (e *UpstreamError) Error() string {
+	return "Upstream error: " + e.Message
+}
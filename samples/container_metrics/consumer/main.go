@@ -21,20 +21,17 @@ func main() {
 
 	fmt.Println("===== Streaming ContainerMetrics (will only succeed if you have admin credentials)")
 
-	for {
-		containerMetrics, err := consumer.ContainerMetrics(appId, authToken)
+	envelopes, errors := consumer.PollContainerMetrics(appId, authToken, 3*time.Second)
 
-		for _, cm := range containerMetrics {
-			fmt.Printf("%v \n", cm)
-		}
-
-		if err != nil {
+	go func() {
+		for err := range errors {
 			fmt.Fprintf(os.Stderr, "%v\n", err.Error())
 		}
+	}()
 
-		time.Sleep(3 * time.Second)
+	for env := range envelopes {
+		fmt.Printf("%v \n", env.GetContainerMetric())
 	}
-
 }
 
 type ConsoleDebugPrinter struct{}
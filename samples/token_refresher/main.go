@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/cloudfoundry-incubator/uaago"
 	"github.com/cloudfoundry/noaa/consumer"
 )
 
@@ -19,16 +18,15 @@ var (
 
 func main() {
 
-	uaa, err := uaago.NewClient(uaaEndpoint)
-	if err != nil {
-		fmt.Printf("Error from uaaClient %s\n", err)
-		os.Exit(1)
-	}
-
-	refresher := tokenRefresher{uaaClient: uaa}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	refresher := consumer.NewCachingTokenRefresher(
+		consumer.NewClientCredentialsRefresher(uaaEndpoint, clientName, clientSecret,
+			consumer.WithUAATLSConfig(tlsConfig),
+		),
+	)
 
-	consumer := consumer.New(dopplerAddress, &tls.Config{InsecureSkipVerify: true}, nil)
-	consumer.RefreshTokenFrom(&refresher)
+	consumer := consumer.New(dopplerAddress, tlsConfig, nil)
+	consumer.RefreshTokenFrom(refresher)
 	consumer.SetDebugPrinter(ConsoleDebugPrinter{})
 
 	fmt.Println("===== Streaming metrics")
@@ -51,15 +49,3 @@ func (c ConsoleDebugPrinter) Print(title, dump string) {
 	println(title)
 	println(dump)
 }
-
-type tokenRefresher struct {
-	uaaClient *uaago.Client
-}
-
-func (t *tokenRefresher) RefreshAuthToken() (string, error) {
-	token, err := t.uaaClient.GetAuthToken(clientName, clientSecret, true)
-	if err != nil {
-		return "", err
-	}
-	return token, nil
-}